@@ -1,11 +1,15 @@
 package labomatic
 
 import (
+	"cmp"
 	"fmt"
 	"hash/maphash"
+	"math/big"
+	"net"
 	"net/netip"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 // Addr exposes IP addresses to Starlark
@@ -35,12 +39,99 @@ func (Addr) Type() string            { return "Addr" }
 func (a Addr) IsValid() bool    { return netip.Addr(a).IsValid() }
 func (a Addr) Addr() netip.Addr { return netip.Addr(a) }
 
-type Mac uint32 // last 3 bytes of self-assigned range
+// Binary implements address arithmetic: addr + n, n + addr, addr - n, and addr - addr (the distance between them).
+func (a Addr) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	switch op {
+	case syntax.PLUS:
+		n, ok := y.(starlark.Int)
+		if !ok {
+			return nil, nil
+		}
+		return a.add(n.BigInt())
+	case syntax.MINUS:
+		if side == starlark.Right {
+			return nil, nil
+		}
+		switch y := y.(type) {
+		case starlark.Int:
+			return a.add(new(big.Int).Neg(y.BigInt()))
+		case Addr:
+			if a.Addr().Is4() != y.Addr().Is4() {
+				return nil, fmt.Errorf("cannot subtract addresses of different families: %s - %s", a, y)
+			}
+			return starlark.MakeBigInt(new(big.Int).Sub(addrInt(a.Addr()), addrInt(y.Addr()))), nil
+		}
+	}
+	return nil, nil
+}
+
+// add returns the address n after a, which must stay in the address family.
+func (a Addr) add(n *big.Int) (starlark.Value, error) {
+	if !a.IsValid() {
+		return nil, fmt.Errorf("invalid address")
+	}
+	sum := n.Add(n, addrInt(a.Addr()))
+	bits := a.Addr().BitLen()
+	if sum.Sign() < 0 || sum.BitLen() > bits {
+		return nil, fmt.Errorf("address %s %+d is out of range", a, n.Sub(n, addrInt(a.Addr())))
+	}
+	buf := sum.FillBytes(make([]byte, bits/8))
+	addr, _ := netip.AddrFromSlice(buf)
+	return Addr(addr), nil
+}
+
+func addrInt(addr netip.Addr) *big.Int { return new(big.Int).SetBytes(addr.AsSlice()) }
+
+// CompareSameType orders addresses, IPv4 before IPv6.
+func (a Addr) CompareSameType(op syntax.Token, y starlark.Value, _ int) (bool, error) {
+	return threeway(op, a.Addr().Compare(y.(Addr).Addr())), nil
+}
+
+// threeway interprets a three-way comparison result cmp as the outcome of a binary comparison operator.
+func threeway(op syntax.Token, cmp int) bool {
+	switch op {
+	case syntax.EQL:
+		return cmp == 0
+	case syntax.NEQ:
+		return cmp != 0
+	case syntax.LE:
+		return cmp <= 0
+	case syntax.LT:
+		return cmp < 0
+	case syntax.GE:
+		return cmp >= 0
+	case syntax.GT:
+		return cmp > 0
+	}
+	panic(op)
+}
+
+// Mac exposes hardware addresses to Starlark
+type Mac [6]byte
+
+// qemuOUI is the locally administered range used by QEMU
+var qemuOUI = [3]byte{0x52, 0x54, 0x00}
 
-func (m Mac) String() string {
-	return fmt.Sprintf("%x:%x:%x", byte(m>>16), byte(m>>8), byte(m))
+// ParseMac reads a unicast MAC address in the usual colon-separated form.
+func ParseMac(s string) (Mac, error) {
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != 6 {
+		return Mac{}, fmt.Errorf("invalid MAC address %q", s)
+	}
+	if hw[0]&1 != 0 {
+		return Mac{}, fmt.Errorf("MAC address %s is not unicast", s)
+	}
+	return Mac(hw), nil
 }
 
+func (Mac) Freeze()                 {}
+func (m Mac) Hash() (uint32, error) { return uint32(maphash.String(hseed, m.String())), nil }
+func (m Mac) String() string        { return net.HardwareAddr(m[:]).String() }
+func (m Mac) Truth() starlark.Bool  { return starlark.Bool(m.IsValid()) }
+func (Mac) Type() string            { return "Mac" }
+
+func (m Mac) IsValid() bool { return m != Mac{} }
+
 type Prefix netip.Prefix
 
 func (Prefix) Freeze()                 {}
@@ -48,3 +139,172 @@ func (r Prefix) Hash() (uint32, error) { return uint32(maphash.String(hseed, r.S
 func (r Prefix) String() string        { return netip.Prefix(r).String() }
 func (r Prefix) Truth() starlark.Bool  { return starlark.Bool(netip.Prefix(r).IsValid()) }
 func (Prefix) Type() string            { return "Prefix" }
+
+// maxExpand is the largest number of values returned by Prefix.subnets and Prefix.hosts
+const maxExpand = 1 << 16
+
+func NewPrefix(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pf string
+	if err := starlark.UnpackArgs("Prefix", args, kwargs, "prefix", &pf); err != nil {
+		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
+	}
+	rs, err := netip.ParsePrefix(pf)
+	if err != nil {
+		return starlark.None, fmt.Errorf("invalid prefix %s: %w", pf, err)
+	}
+	return Prefix(rs.Masked()), nil
+}
+
+// CompareSameType orders prefixes by address, then by length.
+func (r Prefix) CompareSameType(op syntax.Token, y starlark.Value, _ int) (bool, error) {
+	p, q := netip.Prefix(r), netip.Prefix(y.(Prefix))
+	return threeway(op, cmp.Or(p.Addr().Compare(q.Addr()), cmp.Compare(p.Bits(), q.Bits()))), nil
+}
+
+// Binary implements addr in prefix.
+func (r Prefix) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op != syntax.IN || side != starlark.Right {
+		return nil, nil
+	}
+	ok, err := r.contains(y)
+	return starlark.Bool(ok), err
+}
+
+func (r Prefix) contains(v starlark.Value) (bool, error) {
+	pf := netip.Prefix(r)
+	switch v := v.(type) {
+	case Addr:
+		return pf.Contains(v.Addr()), nil
+	case Prefix:
+		return pf.Bits() <= netip.Prefix(v).Bits() && pf.Contains(netip.Prefix(v).Addr()), nil
+	case starlark.String:
+		if ad, err := netip.ParseAddr(string(v)); err == nil {
+			return pf.Contains(ad), nil
+		}
+		if sub, err := netip.ParsePrefix(string(v)); err == nil {
+			return r.contains(Prefix(sub.Masked()))
+		}
+		return false, fmt.Errorf("invalid address or prefix %s", v)
+	}
+	return false, fmt.Errorf("invalid address or prefix %s: want Addr, Prefix or string", v)
+}
+
+func (Prefix) AttrNames() []string {
+	return []string{"bits", "broadcast", "contains", "hosts", "netmask", "network", "nth", "subnets"}
+}
+
+func (r Prefix) Attr(name string) (starlark.Value, error) {
+	pf := netip.Prefix(r)
+	if !pf.IsValid() {
+		return nil, fmt.Errorf("invalid prefix")
+	}
+	switch name {
+	case "bits":
+		return starlark.MakeInt(pf.Bits()), nil
+	case "network":
+		return Addr(pf.Addr()), nil
+	case "broadcast":
+		// also the last address for IPv6, which has no broadcast
+		return Addr(last(pf).Next()), nil
+	case "netmask":
+		mask := make([]byte, pf.Addr().BitLen()/8)
+		for i := range pf.Bits() {
+			mask[i/8] |= 0x80 >> (i % 8)
+		}
+		addr, _ := netip.AddrFromSlice(mask)
+		return Addr(addr), nil
+	case "contains":
+		return prefixContains.BindReceiver(r), nil
+	case "hosts":
+		return prefixHosts.BindReceiver(r), nil
+	case "nth":
+		return prefixNth.BindReceiver(r), nil
+	case "subnets":
+		return prefixSubnets.BindReceiver(r), nil
+	}
+	return nil, starlark.NoSuchAttrError(name)
+}
+
+var prefixContains = starlark.NewBuiltin("contains", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs("contains", args, kwargs, 1, &v); err != nil {
+		return starlark.None, err
+	}
+	ok, err := fn.Receiver().(Prefix).contains(v)
+	return starlark.Bool(ok), err
+})
+
+// nth returns the address n of the prefix, counting from the end if n is negative (-1 is the broadcast address).
+var prefixNth = starlark.NewBuiltin("nth", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var n starlark.Int
+	if err := starlark.UnpackPositionalArgs("nth", args, kwargs, 1, &n); err != nil {
+		return starlark.None, err
+	}
+	pf := netip.Prefix(fn.Receiver().(Prefix))
+	start := Addr(pf.Addr())
+	if n.Sign() < 0 {
+		start = Addr(last(pf).Next())
+		n = n.Add(starlark.MakeInt(1))
+	}
+	addr, err := start.add(n.BigInt())
+	if err != nil || !pf.Contains(netip.Addr(addr.(Addr))) {
+		return starlark.None, fmt.Errorf("address %s not in %s", n, pf)
+	}
+	return addr, nil
+})
+
+// hosts returns the addresses assignable to hosts: all but the network and broadcast addresses in IPv4
+// (except for point-to-point /31 and /32), and all but the subnet-router anycast address in IPv6.
+var prefixHosts = starlark.NewBuiltin("hosts", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs("hosts", args, kwargs, 0); err != nil {
+		return starlark.None, err
+	}
+	pf := netip.Prefix(fn.Receiver().(Prefix))
+	hostbits := pf.Addr().BitLen() - pf.Bits()
+	if hostbits > 16 {
+		return starlark.None, fmt.Errorf("%s has more than %d hosts", pf, maxExpand)
+	}
+
+	first, end := pf.Addr(), last(pf).Next()
+	switch {
+	case pf.Addr().Is4() && hostbits > 1:
+		first = first.Next()
+	case pf.Addr().Is6() && hostbits > 0:
+		first = first.Next()
+		end = end.Next()
+	default:
+		end = end.Next()
+	}
+	var hosts []starlark.Value
+	for ad := first; ad.IsValid() && ad != end; ad = ad.Next() {
+		hosts = append(hosts, Addr(ad))
+	}
+	return starlark.NewList(hosts), nil
+})
+
+var prefixSubnets = starlark.NewBuiltin("subnets", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var bits int
+	if err := starlark.UnpackPositionalArgs("subnets", args, kwargs, 1, &bits); err != nil {
+		return starlark.None, err
+	}
+	pf := netip.Prefix(fn.Receiver().(Prefix))
+	switch {
+	case bits < pf.Bits() || bits > pf.Addr().BitLen():
+		return starlark.None, fmt.Errorf("invalid length %d: want %d to %d", bits, pf.Bits(), pf.Addr().BitLen())
+	case bits-pf.Bits() > 16:
+		return starlark.None, fmt.Errorf("%s has more than %d subnets of length %d", pf, maxExpand, bits)
+	}
+
+	step := new(big.Int).Lsh(big.NewInt(1), uint(pf.Addr().BitLen()-bits))
+	var subnets []starlark.Value
+	ad := Addr(pf.Addr())
+	for range 1 << (bits - pf.Bits()) {
+		subnets = append(subnets, Prefix(netip.PrefixFrom(ad.Addr(), bits)))
+		next, err := ad.add(new(big.Int).Set(step))
+		if err != nil {
+			break // end of the address space
+		}
+		ad = next.(Addr)
+	}
+	return starlark.NewList(subnets), nil
+})
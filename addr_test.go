@@ -0,0 +1,68 @@
+package labomatic
+
+import (
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestAddrArithmetic(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`Addr("10.0.0.1") + 5`, "10.0.0.6"},
+		{`300 + Addr("10.0.0.0")`, "10.0.1.44"},
+		{`Addr("10.0.1.0") - 1`, "10.0.0.255"},
+		{`Addr("10.0.1.0") - Addr("10.0.0.250")`, "6"},
+		{`Addr("fd00::ffff") + 1`, "fd00::1:0"},
+		{`Addr("10.0.0.2") > Addr("10.0.0.1")`, "True"},
+		{`sorted([Addr("10.0.0.9"), Addr("fd00::1"), Addr("10.0.0.10")])`, "[10.0.0.9, 10.0.0.10, fd00::1]"},
+		{`Prefix("10.0.0.0/24").subnets(26)`, "[10.0.0.0/26, 10.0.0.64/26, 10.0.0.128/26, 10.0.0.192/26]"},
+		{`Prefix("10.0.0.0/24").contains(Addr("10.0.0.7"))`, "True"},
+		{`Prefix("10.0.0.0/24").contains("10.0.0.0/16")`, "False"},
+		{`Addr("10.0.1.7") in Prefix("10.0.0.0/24")`, "False"},
+		{`Prefix("10.0.0.0/30").hosts()`, "[10.0.0.1, 10.0.0.2]"},
+		{`Prefix("10.0.0.0/31").hosts()`, "[10.0.0.0, 10.0.0.1]"},
+		{`Prefix("fd00::/126").hosts()`, "[fd00::1, fd00::2, fd00::3]"},
+		{`Prefix("10.0.0.0/20").netmask`, "255.255.240.0"},
+		{`Prefix("10.0.0.0/20").broadcast`, "10.0.15.255"},
+		{`Prefix("10.0.0.0/24").nth(10)`, "10.0.0.10"},
+		{`Prefix("10.0.0.0/24").nth(-2)`, "10.0.0.254"},
+		{`Subnet(network="10.1.0.0/16").network.subnets(17)[1].network`, "10.1.128.0"},
+	}
+
+	for _, c := range cases {
+		got, err := starlark.Eval(&starlark.Thread{}, "test", c.expr, NetBlocks)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		if got.String() != c.want {
+			t.Errorf("%s: want %s, got %s", c.expr, c.want, got)
+		}
+	}
+}
+
+func TestAddrArithmeticErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`Addr("255.255.255.255") + 1`, "out of range"},
+		{`Addr("0.0.0.0") - 1`, "out of range"},
+		{`Addr("fd00::1") - Addr("10.0.0.1")`, "different families"},
+		{`Prefix("10.0.0.0/24").nth(256)`, "not in 10.0.0.0/24"},
+		{`Prefix("10.0.0.0/24").subnets(20)`, "invalid length 20"},
+		{`Prefix("fd00::/48").hosts()`, "more than 65536 hosts"},
+		{`Prefix("10.0.0.0/24").contains("not an address")`, "invalid address or prefix"},
+	}
+
+	for _, c := range cases {
+		_, err := starlark.Eval(&starlark.Thread{}, "test", c.expr, NetBlocks)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: want error %q, got %v", c.expr, c.want, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package labomatic
+
+import (
+	"fmt"
+	"slices"
+
+	"go.starlark.net/starlark"
+)
+
+// DefaultBootConcurrency is the number of nodes booted at the same time, unless the lab sets boot_concurrency.
+var DefaultBootConcurrency = 4
+
+// bootConcurrency returns how many nodes of the lab can boot at the same time.
+// Labs setting boot_order are booted one node at a time, in order.
+func bootConcurrency(globals starlark.StringDict) (int, error) {
+	if _, ok := globals["boot_order"]; ok {
+		return 1, nil
+	}
+	v, ok := globals["boot_concurrency"]
+	if !ok {
+		return DefaultBootConcurrency, nil
+	}
+	var n int
+	if err := starlark.AsInt(v, &n); err != nil || n < 1 {
+		return 0, fmt.Errorf("boot_concurrency must be a positive integer, got %s", v)
+	}
+	return n, nil
+}
+
+// bootNodes calls boot for all nodes, with at most limit calls running at the same time.
+// A node is booted once all the nodes it depends on are booted, and skipped if one of them failed.
+// Nodes are started in order when their dependencies allow it, so a limit of 1 boots them strictly in order.
+// The error of every node that could not be booted is returned.
+func bootNodes(nodes []*netnode, limit int, boot func(*netnode) error) map[*netnode]error {
+	type result struct {
+		node *netnode
+		err  error
+	}
+
+	errs := make(map[*netnode]error)
+	booted := make(map[*netnode]bool)
+	pending := slices.Clone(nodes)
+	done := make(chan result)
+	running := 0
+
+	for len(pending) > 0 || running > 0 {
+		// start all runnable nodes, in order; skipping a node can unblock others
+		for progress := true; progress; {
+			progress = false
+			for i := 0; i < len(pending) && running < limit; {
+				n := pending[i]
+				ready, failed := true, ""
+				for _, dep := range n.deps {
+					switch {
+					case errs[dep] != nil:
+						failed = fmt.Sprintf("dependency %s failed", dep.name)
+					case !slices.Contains(nodes, dep):
+						failed = fmt.Sprintf("dependency %s is not started", dep.name)
+					case !booted[dep]:
+						ready = false
+					}
+				}
+				switch {
+				case failed != "":
+					errs[n] = fmt.Errorf("not started: %s", failed)
+				case ready:
+					running++
+					go func() { done <- result{n, boot(n)} }()
+				default:
+					i++
+					continue
+				}
+				pending = slices.Delete(pending, i, i+1)
+				progress = true
+			}
+		}
+
+		if running == 0 {
+			// nothing can make progress, the remaining nodes depend on each other
+			for _, n := range pending {
+				errs[n] = fmt.Errorf("not started: dependency cycle")
+			}
+			break
+		}
+
+		r := <-done
+		running--
+		if r.err != nil {
+			errs[r.node] = r.err
+		} else {
+			booted[r.node] = true
+		}
+	}
+	return errs
+}
+
+// dependencyCycle returns a cycle of dependencies starting at n, or nil if there is none.
+func dependencyCycle(n *netnode) []*netnode {
+	var path []*netnode
+	var visit func(*netnode) bool
+	visit = func(m *netnode) bool {
+		if len(path) > 0 && m == n {
+			return true
+		}
+		if slices.Contains(path, m) {
+			return false // a cycle not going through n
+		}
+		path = append(path, m)
+		for _, dep := range m.deps {
+			if visit(dep) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(n) {
+		return path
+	}
+	return nil
+}
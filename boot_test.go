@@ -0,0 +1,97 @@
+package labomatic
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBootNodes(t *testing.T) {
+	node := func(name string, deps ...*netnode) *netnode { return &netnode{name: name, deps: deps} }
+	r1 := node("r1")
+	r2 := node("r2", r1)
+	sw1 := node("sw1")
+	a1 := node("a1", r2, sw1)
+	a2 := node("a2")
+	nodes := []*netnode{a1, r2, r1, sw1, a2}
+
+	var (
+		mx       sync.Mutex
+		order    []string
+		running  int
+		maxrun   int
+		finished = make(map[*netnode]bool)
+	)
+	boot := func(n *netnode) error {
+		mx.Lock()
+		for _, dep := range n.deps {
+			if !finished[dep] {
+				t.Errorf("%s booted before its dependency %s", n.name, dep.name)
+			}
+		}
+		order = append(order, n.name)
+		running++
+		maxrun = max(maxrun, running)
+		mx.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mx.Lock()
+		running--
+		finished[n] = true
+		mx.Unlock()
+		return nil
+	}
+
+	if errs := bootNodes(nodes, 2, boot); len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if len(order) != len(nodes) || maxrun != 2 {
+		t.Errorf("want all nodes booted, 2 at a time: got %v, %d at a time", order, maxrun)
+	}
+
+	order, maxrun = nil, 0
+	clear(finished)
+	bootNodes(nodes, 1, boot)
+	if got := strings.Join(order, " "); got != "r1 r2 sw1 a1 a2" {
+		t.Errorf("serial boot: want r1 r2 sw1 a1 a2, got %s", got)
+	}
+}
+
+func TestBootNodesErrors(t *testing.T) {
+	r1 := &netnode{name: "r1"}
+	r2 := &netnode{name: "r2", deps: []*netnode{r1}}
+	a1 := &netnode{name: "a1", deps: []*netnode{r2}}
+	c1 := &netnode{name: "c1"}
+	c2 := &netnode{name: "c2", deps: []*netnode{c1}}
+	c1.deps = []*netnode{c2}
+	orphan := &netnode{name: "orphan", deps: []*netnode{{name: "gone"}}}
+	ok := &netnode{name: "ok"}
+
+	var booted []string
+	errs := bootNodes([]*netnode{a1, r2, r1, c1, c2, orphan, ok}, 4, func(n *netnode) error {
+		if n == r1 {
+			return errors.New("no image")
+		}
+		booted = append(booted, n.name)
+		return nil
+	})
+	if !slices.Equal(booted, []string{"ok"}) {
+		t.Errorf("want only ok booted, got %v", booted)
+	}
+	for n, want := range map[*netnode]string{
+		r1:     "no image",
+		r2:     "dependency r1 failed",
+		a1:     "dependency r2 failed",
+		c1:     "dependency cycle",
+		c2:     "dependency cycle",
+		orphan: "dependency gone is not started",
+	} {
+		if err := errs[n]; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want error %q, got %v", n.name, want, err)
+		}
+	}
+}
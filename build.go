@@ -1,15 +1,18 @@
 package labomatic
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/netip"
 	"os"
 	"os/exec"
-	"os/user"
 	"runtime"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/vishvananda/netlink"
@@ -19,10 +22,10 @@ import (
 )
 
 var masquerade_rule = template.Must(template.New("nft_masquerade").Parse(`
-table inet labomatic
-delete table inet labomatic
+table inet {{ .Table }}
+delete table inet {{ .Table }}
 
-table inet labomatic {
+table inet {{ .Table }} {
 	chain forward {
 		type filter hook forward priority filter; policy accept;
 		{{ range .Interfaces }}
@@ -36,23 +39,78 @@ table inet labomatic {
 }
 `))
 
-// Build creates the full virtual lab from the Starlark definitions.
+// Build creates the full virtual lab from the Starlark definitions, loaded from lab.Labdir, and runs it as lab.Owner.
 // Read status from msg to follow progress (or have a goroutine ignore all messages if not intersted).
-// The term channel can be closed to terminate all current instances.
-func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready chan chan Controller) error {
+// The term channel can be closed to terminate all current instances, and [Instance.Done] is closed once the lab is cleaned up.
+func Build(lab *Instance, nodes starlark.StringDict, msg chan<- string, ready chan chan Controller) (err error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	labdir, runas := lab.Labdir, lab.Owner
+
+	// what the lab holds on the host, released by cleanup once it stops, or as soon as it fails to build.
+	// on failure, this runs after the thread is back in the host namespace.
+	var (
+		nslab   = netns.None()
+		nated   []string
+		nftable bool
+		dhcpds  []*dhcpServer
+		dnssrv  = &dnsServer{}
+	)
+	cleanup := func() {
+		for _, srv := range dhcpds {
+			if err := srv.Close(); err != nil {
+				slog.Warn("cannot stop DHCP server", "error", err)
+			}
+		}
+		if err := dnssrv.Close(); err != nil {
+			slog.Warn("cannot stop DNS server", "error", err)
+		}
+		if nftable {
+			if err := exec.Command("/usr/sbin/nft", "delete", "table", "inet", lab.nftTable()).Run(); err != nil {
+				slog.Warn("cannot delete nft table", "table", lab.nftTable(), "error", err)
+			}
+		}
+		// links in the lab namespace go with it, so the ID can be reused
+		if nslab.IsOpen() {
+			if err := netns.DeleteNamed(lab.netns()); err != nil {
+				slog.Warn("cannot delete lab netns", "errors", err)
+			}
+		}
+		if lab.TmpDir != "" {
+			if err := os.RemoveAll(lab.TmpDir); err != nil {
+				slog.Warn("cannot remove lab files", "error", err)
+			}
+		}
+		close(lab.done)
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+
+	if err := checkResources(nodes); err != nil {
+		return err
+	}
+
 	nsdefault, err := netns.Get()
 	if err != nil {
 		return fmt.Errorf("cannot get handle to existing namespace: %w", err)
 	}
+	// the thread is unlocked when done, and must not leak the lab namespace
+	defer netns.Set(nsdefault)
 
-	nslab, err := netns.NewNamed("lab")
+	nslab, err = netns.NewNamed(lab.netns())
 	if err != nil {
 		return fmt.Errorf("cannot create lab namespace: %w", err)
 	}
 
+	lab.TmpDir, err = os.MkdirTemp("", "labomatic_"+lab.ID+"_")
+	if err != nil {
+		return fmt.Errorf("cannot create temp directory: %w", err)
+	}
+
 	msg <- "<I>Building the Lab"
 
 	{
@@ -76,14 +134,23 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 	}
 
 	// first pass: the bridges
-	var nated []string
+	// kernel link names are generated to fit IFNAMSIZ, and the lab names are kept as alias.
+	var nbr int
+	dnssrv.zone = newZone(labZone(labdir, lab.ID), nodesof(nodes,
+		OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter), OfType(nodeLinux), OfType(nodeHost)))
 	for net := range netsof(nodes) {
+		nbr++
+		net.link = fmt.Sprintf("lbr%d", nbr)
 		br := &netlink.Bridge{
 			LinkAttrs: netlink.LinkAttrs{
-				Name:   net.name,
+				Name:   net.link,
+				Alias:  net.name,
 				TxQLen: -1,
 			},
 		}
+		if net.vlanfiltering {
+			br.VlanFiltering = &net.vlanfiltering
+		}
 		if err := addup(nslab, br); err != nil {
 			return fmt.Errorf("creating bridge: %w", err)
 		}
@@ -91,28 +158,46 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 			continue
 		}
 
+		net.hostlink = fmt.Sprintf("lab%s_%d", lab.ID, nbr)
 		veth := &netlink.Veth{
 			LinkAttrs: netlink.LinkAttrs{
 				NetNsID:     1,
-				Name:        "veth_" + net.name,
+				Name:        fmt.Sprintf("lvh%d", nbr),
+				Alias:       "veth_" + net.name,
 				TxQLen:      -1,
 				MasterIndex: br.Attrs().Index,
 			},
-			PeerName: "lab_" + net.name,
+			PeerName: net.hostlink,
 		}
 		err := addveth(nslab, nsdefault, veth,
+			func(l netlink.Link) error {
+				return netlink.LinkSetAlias(l, "lab_"+net.name)
+			},
 			func(l netlink.Link) error {
 				if net.linkonly {
 					return nil
 				}
 
-				na := netip.PrefixFrom(last(net.network), net.network.Bits()) // last address always assigned to host
-				addr, _ := netlink.ParseAddr(na.String())
-				return netlink.AddrAdd(l, addr)
+				// last address always assigned to host
+				for _, pf := range []netip.Prefix{net.network, net.network6} {
+					if !pf.IsValid() {
+						continue
+					}
+					addr, _ := netlink.ParseAddr(netip.PrefixFrom(last(pf), pf.Bits()).String())
+					if err := netlink.AddrAdd(l, addr); err != nil {
+						return fmt.Errorf("cannot assign host address %s: %w", addr, err)
+					}
+				}
+				return nil
 			},
 			func(l netlink.Link) error {
 				if net.dns.Server == "" {
-					return nil
+					if net.linkonly {
+						return nil
+					}
+					// the host resolves the lab zone, and reverse addresses, from labd
+					net.zone = dnssrv.zone.origin
+					return pointResolver(l.Attrs().Name, net)
 				}
 				if err := exec.Command("/usr/bin/resolvectl", "dns", l.Attrs().Name, net.dns.Server).Run(); err != nil {
 					return fmt.Errorf("cannot configure dns server: %w", err)
@@ -130,8 +215,37 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 			return fmt.Errorf("cannot create host handle: %w", err)
 		}
 		if net.nat {
-			nated = append(nated, "lab_"+net.name)
+			nated = append(nated, net.hostlink)
+		}
+
+		if net.zone == "" && net.dhcp == nil {
+			continue
+		}
+		// sockets are bound to the host link, so must be opened in its namespace
+		revert, err := switchns(nsdefault)
+		if err != nil {
+			return fmt.Errorf("cannot switch to main ns: %w", err)
+		}
+		if net.zone != "" {
+			for _, pf := range []netip.Prefix{net.network, net.network6} {
+				if !pf.IsValid() {
+					continue
+				}
+				if err := dnssrv.Listen(last(pf)); err != nil {
+					revert()
+					return err
+				}
+			}
 		}
+		if net.dhcp != nil {
+			net.dhcpd = newDHCPServer(net)
+			if err := net.dhcpd.Listen(); err != nil {
+				revert()
+				return err
+			}
+			dhcpds = append(dhcpds, net.dhcpd)
+		}
+		revert()
 	}
 
 	if len(nated) > 0 {
@@ -143,11 +257,14 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 			return fmt.Errorf("cannot enable IP forwarding: %w", err)
 		}
 
-		fh, err := os.CreateTemp(TmpDir, "nft_add")
+		fh, err := os.CreateTemp(lab.TmpDir, "nft_add")
 		if err != nil {
 			return fmt.Errorf("cannot create temp file: %w", err)
 		}
-		if err := masquerade_rule.Execute(fh, struct{ Interfaces []string }{nated}); err != nil {
+		if err := masquerade_rule.Execute(fh, struct {
+			Table      string
+			Interfaces []string
+		}{lab.nftTable(), nated}); err != nil {
 			return fmt.Errorf("cannot execute rule, %w", err)
 		}
 		fh.Close()
@@ -155,6 +272,7 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 		if err := exec.Command("/usr/sbin/nft", "-f", fh.Name()).Run(); err != nil {
 			return fmt.Errorf("cannot configure masquerade: %w", err)
 		}
+		nftable = true
 		revert()
 	}
 
@@ -167,13 +285,53 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 		if err != nil {
 			return fmt.Errorf("cannot read user id %s: %w", runas, err)
 		}
-		unix.Chown(TmpDir, int(user), int(group))
+		unix.Chown(lab.TmpDir, int(user), int(group))
+	}
+	limit, err := bootConcurrency(nodes)
+	if err != nil {
+		return err
 	}
-	var errc int
-	var VMS []RunningNode
 
+	// link names are numbered before booting, since nodes boot concurrently
+	var (
+		started []*netnode
+		nnodes  = make(map[*netnode]int)
+	)
 	for node := range nodesof(nodes,
-		OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter)) {
+		OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter), OfType(nodeLinux), OfType(nodeHost)) {
+		started = append(started, node)
+		nnodes[node] = len(started)
+	}
+
+	var (
+		mx  sync.Mutex
+		VMS []RunningNode
+	)
+	errs := bootNodes(started, limit, func(node *netnode) error {
+		// nodes boot in parallel, each one from a thread in the lab namespace.
+		// the thread is never unlocked, and terminates with the goroutine.
+		runtime.LockOSThread()
+		if err := netns.Set(nslab); err != nil {
+			return fmt.Errorf("cannot switch to lab namespace: %w", err)
+		}
+
+		nnode := nnodes[node]
+		if node.typ == nodeHost {
+			msg <- fmt.Sprintf("<D> starting host %s", node.name)
+			for i, iface := range node.ifcs {
+				iface.link = fmt.Sprintf("vh%d_%d", nnode, i)
+			}
+			err := RunHost(lab, node, nslab)
+			// the namespace might exist even on error, and must be cleaned up
+			mx.Lock()
+			VMS = append(VMS, AssetNode{node: node, ns: lab.hostns(node.name)})
+			mx.Unlock()
+			if err != nil {
+				return fmt.Errorf("cannot create host %s: %w", node.name, err)
+			}
+			return nil
+		}
+
 		msg <- fmt.Sprintf("<D> starting VM %s", node.name)
 		taps := make(map[string]*os.File)
 		for i, iface := range node.ifcs {
@@ -182,14 +340,15 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 				return fmt.Errorf("obtaining netlink handle: %w", err)
 			}
 
-			br, err := lk.LinkByName(iface.net.name)
+			br, err := lk.LinkByName(iface.net.link)
 			if err != nil {
 				return fmt.Errorf("cannot find parent bridge %s: %w", iface.net.name, err)
 			}
-			ifname := fmt.Sprintf("%s_e%d", node.name, i)
+			iface.link = fmt.Sprintf("tap%s_%d_%d", lab.ID, nnode, i)
 			tt := &netlink.Tuntap{
 				LinkAttrs: netlink.LinkAttrs{
-					Name:        ifname,
+					Name:        iface.link,
+					Alias:       node.name + "." + iface.name,
 					MasterIndex: br.Attrs().Index,
 					TxQLen:      -1,
 				},
@@ -199,20 +358,37 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 			if err := addup(nslab, tt); err != nil {
 				return fmt.Errorf("creating tap device %w", err)
 			}
+			if err := setVlans(lk, tt, iface.vlans); err != nil {
+				return fmt.Errorf("configuring tap device %s: %w", iface.link, err)
+			}
+			if !iface.impair.IsZero() {
+				if err := iface.impair.apply(lk, tt); err != nil {
+					return fmt.Errorf("impairing tap device %s: %w", iface.link, err)
+				}
+			}
 			taps[iface.name] = tt.Fds[0] // one queue
 		}
 
-		// note this run in the same LockOSThread so that network namespace is kept
-		cm, err := RunVM(node, taps, runas)
+		// the node is ready once provisioned
+		cm, err := RunVM(lab, node, lab.monitor(nnode), taps)
 		if cm != nil {
-			VMS = append(VMS, RunningNode{node: node, cmd: cm})
+			mx.Lock()
+			VMS = append(VMS, VMNode{node: node, cmd: cm, qmp: lab.monitor(nnode)})
+			mx.Unlock()
 		}
 		if err != nil {
-			errc++
-			msg <- fmt.Sprintf("<E>cannot create vm %s: %s", node.name, err)
+			return fmt.Errorf("cannot create vm %s: %w", node.name, err)
+		}
+		msg <- fmt.Sprintf("<D> %s ready", node.name)
+		return nil
+	})
+	errc := len(errs)
+	for _, node := range started {
+		if err, ok := errs[node]; ok {
+			msg <- fmt.Sprintf("<E>%s: %s", node.name, err)
 		}
 	}
-	msg <- fmt.Sprintf("<I>Virtual machines started (%d failed)", errc)
+	msg <- fmt.Sprintf("<I>Nodes started (%d failed)", errc)
 
 	go func() {
 		term := make(chan Controller)
@@ -221,12 +397,74 @@ func Build(nodes starlark.StringDict, runas user.User, msg chan<- string, ready
 		for f := range term {
 			f(slices.Values(VMS))
 		}
-		if err := netns.DeleteNamed("lab"); err != nil {
-			slog.Warn("cannot delete lab netns", "errors", err)
+		cleanup()
+	}()
+	return nil
+}
+
+// checkResources verifies the host can run all nodes in the lab,
+// so that we fail before any network or VM is created.
+func checkResources(nodes starlark.StringDict) error {
+	var want memsize
+	for node := range nodesof(nodes, OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter), OfType(nodeLinux)) {
+		if node.res.cpus > runtime.NumCPU() {
+			return fmt.Errorf("node %s wants %d cpus, but host only has %d", node.name, node.res.cpus, runtime.NumCPU())
 		}
+		want += node.res.memory
+	}
 
-		TelnetNum = 23 // need a stricter write barrier, this is racy
-	}()
+	avail, err := availableMemory()
+	if err != nil {
+		return fmt.Errorf("cannot read host memory: %w", err)
+	}
+	if want > avail {
+		return fmt.Errorf("lab needs %dMiB of memory, but only %dMiB are available", want, avail)
+	}
+	return nil
+}
+
+// availableMemory returns the memory available to start new processes (MemAvailable in /proc/meminfo).
+func availableMemory() (memsize, error) {
+	fh, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		v, ok := strings.CutPrefix(sc.Text(), "MemAvailable:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(v, "kB")))
+		if err != nil {
+			return 0, fmt.Errorf("invalid meminfo line %q", sc.Text())
+		}
+		return memsize(kb / 1024), nil
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable entry in /proc/meminfo")
+}
+
+// pointResolver configures the host resolver to query the lab DNS on link, for the lab zone and the reverse zones of net.
+func pointResolver(link string, net *subnet) error {
+	args := []string{"dns", link}
+	domains := []string{"domain", link, strings.TrimSuffix(net.zone, ".")}
+	for _, pf := range []netip.Prefix{net.network, net.network6} {
+		if pf.IsValid() {
+			args = append(args, last(pf).String())
+			domains = append(domains, "~"+strings.TrimSuffix(reverseZone(pf), "."))
+		}
+	}
+	if err := exec.Command("/usr/bin/resolvectl", args...).Run(); err != nil {
+		return fmt.Errorf("cannot configure dns server: %w", err)
+	}
+	if err := exec.Command("/usr/bin/resolvectl", domains...).Run(); err != nil {
+		return fmt.Errorf("cannot configure dns domain: %w", err)
+	}
 	return nil
 }
 
@@ -239,6 +477,12 @@ func addup(parent netns.NsHandle, lk netlink.Link) error {
 	if err := link.LinkAdd(lk); err != nil {
 		return fmt.Errorf("cannot create device %s: %w", lk.Attrs().Name, err)
 	}
+	// not all link types set the alias on creation (e.g. tuntap)
+	if alias := lk.Attrs().Alias; alias != "" {
+		if err := link.LinkSetAlias(lk, alias); err != nil {
+			return fmt.Errorf("cannot set alias on %s: %w", lk.Attrs().Name, err)
+		}
+	}
 	if err := link.LinkSetUp(lk); err != nil {
 		return fmt.Errorf("cannot start interface %s: %w", lk.Attrs().Name, err)
 	}
@@ -312,12 +556,4 @@ var (
 	ImagesDefaultLocation = "/usr/lib/labomatic"
 	MikrotikImage         = "routeros.img"
 	CyberOSImage          = "csw.img"
-
-	TmpDir string
-
-	TelnetNum = 23 // standard telnet
 )
-
-func init() {
-	TmpDir, _ = os.MkdirTemp("", "labomatic_")
-}
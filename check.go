@@ -0,0 +1,276 @@
+package labomatic
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// FileOptions is the Starlark dialect of lab definitions.
+var FileOptions = &syntax.FileOptions{
+	TopLevelControl: true,
+	Set:             true,
+	GlobalReassign:  true,
+}
+
+// Diagnostic is a problem found in a lab definition.
+// Warnings do not prevent the lab from starting.
+type Diagnostic struct {
+	Pos     syntax.Position
+	Warning bool
+	Msg     string
+}
+
+// String formats the diagnostic like compilers do, file:line:col: message
+func (d Diagnostic) String() string {
+	if d.Warning {
+		return d.Pos.String() + ": warning: " + d.Msg
+	}
+	return d.Pos.String() + ": " + d.Msg
+}
+
+// HasErrors reports if any diagnostic is not a warning.
+func HasErrors(diags []Diagnostic) bool {
+	return slices.ContainsFunc(diags, func(d Diagnostic) bool { return !d.Warning })
+}
+
+// Check loads the lab definition (conf.star) in labdir without building anything, and reports problems found.
+// workdir is the base directory of relative image paths, and params the parameters available to the definition.
+// The globals of the definition are returned if it loads.
+func Check(labdir, workdir string, params map[string]string) (starlark.StringDict, []Diagnostic) {
+	full := filepath.Join(labdir, "conf.star")
+
+	th := &starlark.Thread{Name: full}
+	th.SetLocal("workdir", workdir)
+	th.SetLocal("labdir", labdir)
+	lp := newParams(full, params)
+	th.SetLocal(labparamsKey, lp)
+
+	predeclared := maps.Clone(NetBlocks)
+	predeclared["params"] = lp
+	globals, err := starlark.ExecFileOptions(FileOptions, th, full, nil, predeclared)
+	if err != nil {
+		return nil, loadDiagnostics(full, err)
+	}
+	return globals, checkLab(th, globals)
+}
+
+// loadDiagnostics converts the errors of the Starlark interpreter.
+func loadDiagnostics(file string, err error) []Diagnostic {
+	var (
+		serr  syntax.Error
+		rerrs resolve.ErrorList
+		eerr  *starlark.EvalError
+	)
+	switch {
+	case errors.As(err, &serr):
+		return []Diagnostic{{Pos: serr.Pos, Msg: serr.Msg}}
+	case errors.As(err, &rerrs):
+		var diags []Diagnostic
+		for _, e := range rerrs {
+			diags = append(diags, Diagnostic{Pos: e.Pos, Msg: e.Msg})
+		}
+		return diags
+	case errors.As(err, &eerr):
+		// report in the script, not in the builtin
+		pos := syntax.MakePosition(&file, 0, 0)
+		for i := range eerr.CallStack {
+			if fr := eerr.CallStack.At(i); fr.Pos.Filename() == file {
+				pos = fr.Pos
+				break
+			}
+		}
+		return []Diagnostic{{Pos: pos, Msg: eerr.Msg}}
+	}
+	return []Diagnostic{{Pos: syntax.MakePosition(&file, 0, 0), Msg: err.Error()}}
+}
+
+// checkLab verifies the loaded lab, in th.
+// Problems local to a single call (e.g. NAT subnets without static addresses) are already errors during the load.
+func checkLab(th *starlark.Thread, globals starlark.StringDict) []Diagnostic {
+	nm := namesof(th)
+	var diags []Diagnostic
+	report := func(pos syntax.Position, warn bool, format string, args ...any) {
+		diags = append(diags, Diagnostic{Pos: pos, Warning: warn, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	// all nodes and subnets defined, including those not bound to a global
+	var (
+		nodes []*netnode
+		nets  []*subnet
+	)
+	addnet := func(net *subnet) {
+		if slices.Contains(nets, net) {
+			return
+		}
+		nets = append(nets, net)
+		for _, ifc := range net.mbs {
+			if !slices.Contains(nodes, ifc.host) {
+				nodes = append(nodes, ifc.host)
+			}
+		}
+	}
+	for _, v := range globals {
+		switch v := v.(type) {
+		case *netnode:
+			if !slices.Contains(nodes, v) {
+				nodes = append(nodes, v)
+			}
+		case *subnet:
+			addnet(v)
+		}
+	}
+	for i := 0; i < len(nodes); i++ { // nodes grows as subnets are found
+		for _, ifc := range nodes[i].ifcs {
+			addnet(ifc.net)
+		}
+	}
+	// in definition order, so the first use of an address is the reference
+	slices.SortFunc(nodes, func(a, b *netnode) int { return comparePos(nm.used[a.name], nm.used[b.name]) })
+	slices.SortFunc(nets, func(a, b *subnet) int { return comparePos(nm.used[a.name], nm.used[b.name]) })
+
+	if order, ok := globals["boot_order"]; ok {
+		if _, ok := order.(*starlark.List); !ok {
+			report(syntax.MakePosition(&th.Name, 0, 0), false, "boot_order must be a list of nodes, got %s", order.Type())
+			return diags
+		}
+	}
+	var started []*netnode
+	for n := range nodesof(globals, OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter), OfType(nodeLinux), OfType(nodeHost)) {
+		started = append(started, n)
+	}
+	for _, n := range nodes {
+		if slices.Contains(started, n) {
+			continue
+		}
+		if _, ok := globals["boot_order"]; ok {
+			report(nm.used[n.name], false, "node %s is never started: it is not in boot_order", n.name)
+		} else {
+			report(nm.used[n.name], false, "node %s is never started: it is not bound to a global variable", n.name)
+		}
+	}
+
+	if _, err := bootConcurrency(globals); err != nil {
+		report(syntax.MakePosition(&th.Name, 0, 0), false, "%s", err)
+	}
+	_, serial := globals["boot_order"]
+	for _, n := range nodes {
+		if !slices.Contains(started, n) {
+			continue
+		}
+		for _, dep := range n.deps {
+			switch {
+			case !slices.Contains(started, dep):
+				report(nm.used[n.name], false, "node %s depends on %s, which is never started", n.name, dep.name)
+			case serial && slices.Index(started, dep) > slices.Index(started, n):
+				report(nm.used[n.name], false, "node %s depends on %s, which comes later in boot_order", n.name, dep.name)
+			}
+		}
+		// reported once, on the first node of the cycle
+		cycle := dependencyCycle(n)
+		if cycle == nil || slices.ContainsFunc(cycle, func(m *netnode) bool { return slices.Index(nodes, m) < slices.Index(nodes, n) }) {
+			continue
+		}
+		var names []string
+		for _, m := range append(cycle, n) {
+			names = append(names, m.name)
+		}
+		report(nm.used[n.name], false, "dependency cycle: %s", strings.Join(names, " -> "))
+	}
+
+	for i, a := range nets {
+		for _, b := range nets[i+1:] {
+			for _, pf := range [][2]netip.Prefix{{a.network, b.network}, {a.network6, b.network6}} {
+				if !pf[0].IsValid() || !pf[1].IsValid() || !pf[0].Overlaps(pf[1]) {
+					continue
+				}
+				// isolated segments can reuse addresses, but the host cannot route to both
+				report(nm.used[b.name], !(a.host && b.host), "subnet %s (%s) overlaps subnet %s (%s) defined at %s",
+					b.name, pf[1], a.name, pf[0], nm.used[a.name])
+			}
+		}
+	}
+
+	type use struct {
+		ifc  *netiface
+		node *netnode
+	}
+	addrs := make(map[netip.Addr]use)
+	for _, n := range nodes {
+		for _, ifc := range n.ifcs {
+			pos := ifc.pos
+			net := ifc.net
+			for _, ad := range []struct {
+				addr Addr
+				pf   netip.Prefix
+			}{{ifc.addr, net.network}, {ifc.addr6, net.network6}} {
+				if !ad.addr.IsValid() {
+					continue
+				}
+				addr := ad.addr.Addr()
+				switch {
+				case !ad.pf.Contains(addr):
+					report(pos, false, "address %s of %s.%s is not in subnet %s (%s)", addr, n.name, ifc.name, net.name, ad.pf)
+				case net.host && addr == last(ad.pf):
+					report(pos, false, "address %s of %s.%s is reserved for the host in subnet %s", addr, n.name, ifc.name, net.name)
+				}
+				if prev, ok := addrs[addr]; ok {
+					report(pos, prev.ifc.net != net, "address %s of %s.%s is also used by %s.%s at %s",
+						addr, n.name, ifc.name, prev.node.name, prev.ifc.name, prev.ifc.pos)
+				} else {
+					addrs[addr] = use{ifc, n}
+				}
+			}
+		}
+	}
+
+	// names too long for the lab DNS are answered with a server failure.
+	// the lab is not started yet, so its zone is checked without the instance ID.
+	zone := labZone(labdirof(th), "")
+	if err := dnsName(zone); err != nil {
+		report(syntax.MakePosition(&th.Name, 0, 0), true, "lab zone %s cannot be served by the lab DNS: %s", zone, err)
+	} else {
+		for _, n := range nodes {
+			for _, ifc := range n.ifcs {
+				if !ifc.addr.IsValid() && !ifc.addr6.IsValid() {
+					continue
+				}
+				name := strings.ToLower(n.name+"."+ifc.name) + "." + zone
+				if err := dnsName(name); err != nil {
+					report(nm.used[n.name], true, "node %s cannot be resolved in the lab DNS: %s", n.name, err)
+					break
+				}
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		if _, err := n.initTemplate(); err != nil {
+			report(nm.used[n.name], false, "init script of %s: %s", n.name, err)
+		}
+	}
+
+	if lp, ok := th.Local(labparamsKey).(*labParams); ok {
+		diags = append(diags, lp.diagnostics()...)
+	}
+
+	slices.SortStableFunc(diags, func(a, b Diagnostic) int { return comparePos(a.Pos, b.Pos) })
+	return diags
+}
+
+func comparePos(a, b syntax.Position) int {
+	return cmp.Or(
+		strings.Compare(a.Filename(), b.Filename()),
+		cmp.Compare(a.Line, b.Line),
+		cmp.Compare(a.Col, b.Col),
+	)
+}
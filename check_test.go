@@ -0,0 +1,133 @@
+package labomatic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"clean", `
+lan = Subnet(network="10.0.0.0/24")
+r1 = Router()
+r1.attach_nic(lan, addr=lan.addr(1))
+`, nil},
+		{"syntax", `
+r1 = Router()
+r1.init_script = """
+`, []string{"conf.star:3:18: unexpected EOF in string"}},
+		{"undefined", `
+r1 = Router()
+r1.attach_nic(datanet)
+r1.attach_nic(hostnet)
+`, []string{"conf.star:3:15: undefined: datanet", "conf.star:4:15: undefined: hostnet"}},
+		{"runtime", `
+lan = Subnet(network="10.0.0.0/24")
+r1 = Router()
+r1.attach_nic(lan, addr=lan.addr(1))
+r1.attach_nic(lan, addr=lan.addr(1))
+`, []string{"conf.star:5:14: address 10.0.0.1 already used in subnet br1"}},
+		{"overlap", `
+a = Subnet(network="10.10.0.0/16")
+b = Subnet(network="10.10.1.0/24", host=True)
+c = Subnet(network="10.10.2.0/24", host=True)
+r1 = Router()
+r1.attach_nic(a)
+r1.attach_nic(b)
+r1.attach_nic(c)
+`, []string{
+			"conf.star:3:11: warning: subnet br2 (10.10.1.0/24) overlaps subnet br1 (10.10.0.0/16) defined at conf.star:2:11",
+			"conf.star:4:11: warning: subnet br3 (10.10.2.0/24) overlaps subnet br1 (10.10.0.0/16) defined at conf.star:2:11",
+		}},
+		{"addresses", `
+lan = Subnet(network="10.0.0.0/24", host=True)
+other = Subnet(network="10.0.0.0/24")
+r1 = Router()
+r1.attach_nic(lan, addr="10.0.1.1")
+r1.attach_nic(lan, addr="10.0.0.254")
+r1.attach_nic(other, addr="10.0.0.254")
+`, []string{
+			"conf.star:3:15: warning: subnet br2 (10.0.0.0/24) overlaps subnet br1 (10.0.0.0/24) defined at conf.star:2:13",
+			"conf.star:5:14: address 10.0.1.1 of r1.ether2 is not in subnet br1 (10.0.0.0/24)",
+			"conf.star:6:14: address 10.0.0.254 of r1.ether3 is reserved for the host in subnet br1",
+			"conf.star:7:14: warning: address 10.0.0.254 of r1.ether4 is also used by r1.ether3 at conf.star:6:14",
+		}},
+		{"nat", `
+wan = Outnet()
+r1 = Router()
+r1.attach_nic(wan)
+r1.attach_nic(wan, addr=wan.addr(2))
+`, []string{"conf.star:4:14: Outnet links must be statically addressed"}},
+		{"boot order", `
+lan = Subnet(link_only=True)
+r1 = Router()
+r2 = Router()
+r1.attach_nic(lan)
+[Router() for i in range(1)][0].attach_nic(lan)
+boot_order = [r1]
+`, []string{
+			"conf.star:4:12: node r2 is never started: it is not in boot_order",
+			"conf.star:6:8: node r3 is never started: it is not in boot_order",
+		}},
+		{"init script", `
+r1 = Router()
+r1.init_script = """
+/ip/address/add address={{ .Address }
+"""
+`, []string{`conf.star:2:12: init script of r1: template: init_script:2: unexpected "}" in operand`}},
+		{"dependencies", `
+r1 = Router()
+r2 = Router()
+r3 = Router()
+r1.depends_on = [r3]
+r2.depends_on = [r3]
+r3.depends_on = [r2]
+boot_order = [r1, r2, r3]
+`, []string{
+			"conf.star:2:12: node r1 depends on r3, which comes later in boot_order",
+			"conf.star:3:12: node r2 depends on r3, which comes later in boot_order",
+			"conf.star:3:12: dependency cycle: r2 -> r3 -> r2",
+		}},
+		{"dns names", `
+lan = Subnet(network="10.0.0.0/24")
+r1 = Router(name="r1-` + strings.Repeat("x", 64) + `")
+r1.attach_nic(lan, addr=lan.addr(1))
+`, []string{"conf.star:3:12: warning: node r1-" + strings.Repeat("x", 64) + " cannot be resolved in the lab DNS: label r1-" + strings.Repeat("x", 64) + " is longer than 63 bytes"}},
+		{"boot concurrency", `
+r1 = Router()
+boot_concurrency = 0
+`, []string{"conf.star: boot_concurrency must be a positive integer, got 0"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "conf.star"), []byte(c.script), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, diags := Check(dir, dir, nil)
+			var got []string
+			for _, d := range diags {
+				got = append(got, strings.ReplaceAll(d.String(), dir+"/", ""))
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("want diagnostics\n%s\ngot\n%s", strings.Join(c.want, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestCheckTestdata(t *testing.T) {
+	if _, diags := Check("testdata/lab1", "testdata", nil); !HasErrors(diags) {
+		t.Errorf("testdata/lab1 is invalid, got %v", diags)
+	}
+	if _, diags := Check("testdata/lab2", "testdata", nil); len(diags) > 0 {
+		t.Errorf("testdata/lab2 is valid, got %v", diags)
+	}
+}
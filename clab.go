@@ -0,0 +1,263 @@
+package labomatic
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clabTopology is the subset of a containerlab topology file (*.clab.yml) that is imported.
+// See https://containerlab.dev/manual/topo-def-file/
+type clabTopology struct {
+	Name     string `yaml:"name"`
+	Topology struct {
+		Defaults clabNode            `yaml:"defaults"`
+		Kinds    map[string]clabNode `yaml:"kinds"`
+		Nodes    map[string]clabNode `yaml:"nodes"`
+		Links    []clabLink          `yaml:"links"`
+	} `yaml:"topology"`
+}
+
+type clabNode struct {
+	Kind  string `yaml:"kind"`
+	Image string `yaml:"image"`
+}
+
+type clabLink struct {
+	Type      string         `yaml:"type"`
+	Endpoints []clabEndpoint `yaml:"endpoints"`
+}
+
+// clabEndpoint is either written "node:interface", or as a mapping in the extended link format.
+type clabEndpoint struct {
+	Node      string `yaml:"node"`
+	Interface string `yaml:"interface"`
+}
+
+func (e *clabEndpoint) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		node, ifc, ok := strings.Cut(value.Value, ":")
+		if !ok {
+			return fmt.Errorf("line %d: invalid endpoint %q: want node:interface", value.Line, value.Value)
+		}
+		e.Node, e.Interface = node, ifc
+		return nil
+	}
+	type plain clabEndpoint
+	return value.Decode((*plain)(e))
+}
+
+// ClabKinds maps containerlab kinds to the node constructor used on import.
+// Kinds not listed are imported as Asset.
+var ClabKinds = map[string]string{
+	"mikrotik_ros":    "Router",
+	"vr-ros":          "Router",
+	"vr-mikrotik_ros": "Router",
+	"linux":           "Linux",
+	"generic_vm":      "Asset",
+}
+
+// containerlab nodes standing for a shared segment, not for a VM
+var clabBridges = []string{"bridge", "ovs-bridge"}
+
+// ImportContainerlab reads a containerlab topology, and writes the equivalent lab definition (conf.star) into.
+// kinds overrides the mapping in [ClabKinds].
+//
+// Bridges become a single link_only subnet, and every other link a link_only subnet between its two endpoints.
+// Interfaces are attached in the order of their containerlab names (eth1 before eth2);
+// links to the host or the management network are not imported.
+func ImportContainerlab(into io.Writer, topo io.Reader, kinds map[string]string) error {
+	var ct clabTopology
+	if err := yaml.NewDecoder(topo).Decode(&ct); err != nil {
+		return fmt.Errorf("invalid containerlab topology: %w", err)
+	}
+	if len(ct.Topology.Nodes) == 0 {
+		return fmt.Errorf("invalid containerlab topology: no nodes")
+	}
+
+	var buf strings.Builder
+	if ct.Name != "" {
+		fmt.Fprintf(&buf, "# Imported from containerlab topology %s\n\n", ct.Name)
+	} else {
+		buf.WriteString("# Imported from containerlab topology\n\n")
+	}
+
+	vars := make(map[string]string) // containerlab node → Starlark variable
+	used := make(map[string]bool)
+	varname := func(name string) string {
+		v := []rune(name)
+		for i, r := range v {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_') {
+				v[i] = '_'
+			}
+		}
+		s := string(v)
+		if s == "" || '0' <= s[0] && s[0] <= '9' || isReserved(s) {
+			s = "n_" + s
+		}
+		for i := 2; used[s]; i++ {
+			s = fmt.Sprintf("%s_%d", strings.TrimRight(s, "_0123456789"), i)
+		}
+		used[s] = true
+		return s
+	}
+	for _, v := range NetBlocks.Keys() {
+		used[v] = true
+	}
+
+	names := make([]string, 0, len(ct.Topology.Nodes))
+	for name := range ct.Topology.Nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var bridges []string
+	for _, name := range names {
+		cn := ct.Topology.Nodes[name]
+		kind := cmp.Or(cn.Kind, ct.Topology.Defaults.Kind)
+		image := cmp.Or(cn.Image, ct.Topology.Kinds[kind].Image, ct.Topology.Defaults.Image)
+		if kind == "" {
+			return fmt.Errorf("node %s: no kind", name)
+		}
+		vars[name] = varname(name)
+		if slices.Contains(clabBridges, kind) {
+			bridges = append(bridges, name)
+			continue
+		}
+
+		ctor, ok := kinds[kind]
+		if !ok {
+			ctor = cmp.Or(ClabKinds[kind], "Asset")
+		}
+		args := []string{fmt.Sprintf("name=%q", clabName(name))}
+		switch ctor {
+		default:
+			return fmt.Errorf("node %s: cannot import kind %s as %s (want Router, CyberSwitch, Asset, Linux or Host)", name, kind, ctor)
+		case "Router", "Asset", "Host":
+		case "CyberSwitch":
+			if image != "" {
+				args = append(args, fmt.Sprintf("image=%q", image))
+			}
+		case "Linux":
+			// cloud images are required, containerlab only provides the image name as a hint
+			args = append(args, fmt.Sprintf("image=%q", image))
+		}
+		fmt.Fprintf(&buf, "%s = %s(%s)  # kind %s\n", vars[name], ctor, strings.Join(args, ", "), kind)
+	}
+	buf.WriteString("\n")
+
+	for _, name := range bridges {
+		fmt.Fprintf(&buf, "%s = Subnet(name=%q, link_only=True)\n", vars[name], clabName(name))
+	}
+
+	type attachment struct {
+		ifc, net string
+	}
+	attached := make(map[string][]attachment)
+	nlinks := 0
+	for i, ln := range ct.Topology.Links {
+		if ln.Type != "" && ln.Type != "veth" || len(ln.Endpoints) != 2 {
+			fmt.Fprintf(&buf, "# link %d (%s) not imported: only links between two nodes are supported\n", i+1, cmp.Or(ln.Type, "veth"))
+			continue
+		}
+		a, b := ln.Endpoints[0], ln.Endpoints[1]
+		if _, ok := vars[a.Node]; !ok {
+			fmt.Fprintf(&buf, "# link %s:%s -- %s:%s not imported: %s is not a node\n", a.Node, a.Interface, b.Node, b.Interface, a.Node)
+			continue
+		}
+		if _, ok := vars[b.Node]; !ok {
+			fmt.Fprintf(&buf, "# link %s:%s -- %s:%s not imported: %s is not a node\n", a.Node, a.Interface, b.Node, b.Interface, b.Node)
+			continue
+		}
+
+		var net string
+		switch {
+		case slices.Contains(bridges, a.Node) && slices.Contains(bridges, b.Node):
+			fmt.Fprintf(&buf, "# link %s:%s -- %s:%s not imported: bridges cannot be linked together\n", a.Node, a.Interface, b.Node, b.Interface)
+			continue
+		case slices.Contains(bridges, a.Node):
+			net = vars[a.Node]
+		case slices.Contains(bridges, b.Node):
+			net = vars[b.Node]
+		default:
+			nlinks++
+			net = varname(fmt.Sprintf("link%d", nlinks))
+			fmt.Fprintf(&buf, "%s = Subnet(link_only=True)  # %s:%s -- %s:%s\n", net, a.Node, a.Interface, b.Node, b.Interface)
+		}
+		for _, ep := range ln.Endpoints {
+			if !slices.Contains(bridges, ep.Node) {
+				attached[ep.Node] = append(attached[ep.Node], attachment{ep.Interface, net})
+			}
+		}
+	}
+
+	for _, name := range names {
+		if len(attached[name]) == 0 {
+			continue
+		}
+		buf.WriteString("\n")
+		slices.SortStableFunc(attached[name], func(a, b attachment) int { return compareIfname(a.ifc, b.ifc) })
+		for _, at := range attached[name] {
+			fmt.Fprintf(&buf, "%s.attach_nic(%s)  # %s\n", vars[name], at.net, at.ifc)
+		}
+	}
+
+	_, err := io.WriteString(into, buf.String())
+	return err
+}
+
+// clabName replaces the characters not allowed in node names.
+func clabName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if invalidNameChar(r) {
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+// compareIfname orders interface names naturally: eth2 before eth10, e1-2 before e1-10.
+func compareIfname(a, b string) int {
+	for a != "" && b != "" {
+		da, ra := splitDigits(a)
+		db, rb := splitDigits(b)
+		if da != "" && db != "" {
+			na, _ := strconv.Atoi(da)
+			nb, _ := strconv.Atoi(db)
+			if na != nb {
+				return cmp.Compare(na, nb)
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return cmp.Compare(a[0], b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// isReserved reports if s is a Starlark keyword, or a name reserved for future use.
+func isReserved(s string) bool {
+	switch s {
+	case "and", "as", "assert", "break", "class", "continue", "def", "del", "elif", "else", "except", "finally",
+		"for", "from", "global", "if", "import", "in", "is", "lambda", "load", "nonlocal", "not", "or", "pass",
+		"raise", "return", "try", "while", "with", "yield", "True", "False", "None", "boot_order", "boot_concurrency":
+		return true
+	}
+	return false
+}
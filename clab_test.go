@@ -0,0 +1,76 @@
+package labomatic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportContainerlab(t *testing.T) {
+	const topo = `
+name: branch
+topology:
+  defaults:
+    kind: mikrotik_ros
+  kinds:
+    linux:
+      image: debian-12-genericcloud-amd64.qcow2
+  nodes:
+    edge-1:
+    core:
+      kind: ceos
+    pc1:
+      kind: linux
+    lan:
+      kind: bridge
+    boot_concurrency:
+  links:
+    - endpoints: ["edge-1:eth10", "core:eth1"]
+    - endpoints: ["edge-1:eth2", "lan:p1"]
+    - type: veth
+      endpoints:
+        - node: pc1
+          interface: eth1
+        - node: lan
+          interface: p2
+    - endpoints: ["edge-1:eth3", "host:edge1"]
+`
+	var out strings.Builder
+	if err := ImportContainerlab(&out, strings.NewReader(topo), map[string]string{"ceos": "CyberSwitch"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`core = CyberSwitch(name="core")  # kind ceos`,
+		`edge_1 = Router(name="edge-1")  # kind mikrotik_ros`,
+		`pc1 = Linux(name="pc1", image="debian-12-genericcloud-amd64.qcow2")  # kind linux`,
+		`lan = Subnet(name="lan", link_only=True)`,
+		`link1 = Subnet(link_only=True)  # edge-1:eth10 -- core:eth1`,
+		"# link edge-1:eth3 -- host:edge1 not imported: host is not a node",
+		"edge_1.attach_nic(lan)  # eth2\nedge_1.attach_nic(link1)  # eth10",
+		"pc1.attach_nic(lan)  # eth1",
+		`n_boot_concurrency = Router(name="boot_concurrency")  # kind mikrotik_ros`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("conf.star lacks %s:\n%s", want, out.String())
+		}
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "conf.star"), []byte(out.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, diags := Check(dir, dir, nil); len(diags) > 0 {
+		t.Errorf("imported lab is invalid: %v\n%s", diags, out.String())
+	}
+}
+
+func TestCompareIfname(t *testing.T) {
+	sorted := []string{"e1-2", "e1-10", "e2-1", "eth1", "eth2", "eth10", "ether"}
+	for i := range sorted[1:] {
+		if compareIfname(sorted[i], sorted[i+1]) >= 0 {
+			t.Errorf("want %s before %s", sorted[i], sorted[i+1])
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/TroutSoftware/labomatic"
 	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
 )
 
 func main() {
@@ -37,8 +41,12 @@ func main() {
 		fmt.Println("unknown action: use \"start\" or \"stop\"")
 		os.Exit(1)
 	case "start":
+		// start [-D key=value]… <lab>
+		fs, params := labFlags("start")
+		fs.Parse(flag.Args()[1:])
+		labdir = fs.Arg(0)
 		if labdir == "" {
-			fmt.Println("invalid usage: want \"start\" <lab>")
+			fmt.Println("invalid usage: want \"start\" [-D key=value]… <lab>")
 			os.Exit(1)
 		}
 		if !filepath.IsAbs(labdir) {
@@ -46,30 +54,247 @@ func main() {
 		}
 
 		call := lab.CallWithContext(context.TODO(), "Start", dbus.FlagAllowInteractiveAuthorization,
-			labdir, *basedir)
+			labdir, *basedir, params)
 		if call.Err != nil {
 			fmt.Println("error starting the lab:", call.Err)
 			os.Exit(1)
 		}
+		// warnings on stderr, so that the lab ID can be captured
+		fmt.Fprint(os.Stderr, call.Body[1].(string))
+		fmt.Println(call.Body[0].(string)) // the lab ID, for other actions
+	case "check":
+		// check [-D key=value]… <lab>
+		fs, params := labFlags("check")
+		fs.Parse(flag.Args()[1:])
+		labdir = fs.Arg(0)
+		if labdir == "" {
+			fmt.Println("invalid usage: want \"check\" [-D key=value]… <lab>")
+			os.Exit(1)
+		}
+		if !filepath.IsAbs(labdir) {
+			labdir = filepath.Join(wd, labdir)
+		}
+
+		call := lab.CallWithContext(context.TODO(), "Check", 0, labdir, *basedir, params)
+		if call.Err != nil {
+			fmt.Println("cannot check the lab:", call.Err)
+			os.Exit(1)
+		}
+		diags := call.Body[0].(string)
+		fmt.Print(diags)
+		for _, line := range strings.Split(diags, "\n") {
+			if line != "" && !strings.Contains(line, ": warning: ") {
+				os.Exit(1)
+			}
+		}
+	case "export":
+		// export [--format dot|json] [-D key=value]… <lab>
+		fs, params := labFlags("export")
+		format := fs.String("format", "json", "output format, dot or json")
+		fs.Parse(flag.Args()[1:])
+		labdir = fs.Arg(0)
+		if labdir == "" {
+			fmt.Println("invalid usage: want \"export\" [--format dot|json] [-D key=value]… <lab>")
+			os.Exit(1)
+		}
+
+		globals, diags := labomatic.Check(labdir, *basedir, params)
+		if labomatic.HasErrors(diags) {
+			for _, d := range diags {
+				fmt.Println(d)
+			}
+			os.Exit(1)
+		}
+		if err := labomatic.Export(os.Stdout, globals, *format); err != nil {
+			fmt.Println("cannot export the lab:", err)
+			os.Exit(1)
+		}
+	case "render":
+		// render [-D key=value]… <lab> <node>
+		fs, params := labFlags("render")
+		fs.Parse(flag.Args()[1:])
+		labdir = fs.Arg(0)
+		if labdir == "" || fs.Arg(1) == "" {
+			fmt.Println("invalid usage: want \"render\" [-D key=value]… <lab> <node>")
+			os.Exit(1)
+		}
+
+		globals, diags := labomatic.Check(labdir, *basedir, params)
+		if labomatic.HasErrors(diags) {
+			for _, d := range diags {
+				fmt.Println(d)
+			}
+			os.Exit(1)
+		}
+		if err := labomatic.RenderInit(os.Stdout, globals, fs.Arg(1)); err != nil {
+			fmt.Println("cannot render the init script:", err)
+			os.Exit(1)
+		}
+	case "import":
+		// import [--kind ceos=CyberSwitch]… <topology.clab.yml>
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		kinds := make(map[string]string)
+		fs.Func("kind", "node type of a containerlab kind, as kind=Type (repeatable)", func(kv string) error {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("want kind=Type")
+			}
+			kinds[k] = v
+			return nil
+		})
+		fs.Parse(flag.Args()[1:])
+		if fs.Arg(0) == "" {
+			fmt.Println("invalid usage: want \"import\" [--kind kind=Type]… <topology.clab.yml>")
+			os.Exit(1)
+		}
+
+		fh, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Println("cannot read the topology:", err)
+			os.Exit(1)
+		}
+		defer fh.Close()
+		if err := labomatic.ImportContainerlab(os.Stdout, fh, kinds); err != nil {
+			fmt.Println("cannot import the topology:", err)
+			os.Exit(1)
+		}
+	case "ls":
+		call := lab.CallWithContext(context.TODO(), "List", 0)
+		if call.Err != nil {
+			fmt.Println("cannot list labs:", call.Err)
+			os.Exit(1)
+		}
+		fmt.Print(call.Body[0].(string))
 	case "status":
-		call := lab.CallWithContext(context.TODO(), "Status", dbus.FlagAllowInteractiveAuthorization)
+		// status <id>
+		if flag.NArg() < 2 {
+			fmt.Println("invalid usage: want \"status\" <id>")
+			os.Exit(1)
+		}
+		call := lab.CallWithContext(context.TODO(), "Status", dbus.FlagAllowInteractiveAuthorization, flag.Arg(1))
 		if call.Err != nil {
 			fmt.Println("cannot read lab status:", call.Err)
 			os.Exit(1)
 		}
 		fmt.Println(call.Body[0].(string))
+	case "links":
+		// links <id>
+		if flag.NArg() < 2 {
+			fmt.Println("invalid usage: want \"links\" <id>")
+			os.Exit(1)
+		}
+		call := lab.CallWithContext(context.TODO(), "Links", dbus.FlagAllowInteractiveAuthorization, flag.Arg(1))
+		if call.Err != nil {
+			fmt.Println("cannot read lab links:", call.Err)
+			os.Exit(1)
+		}
+		fmt.Println(call.Body[0].(string))
+	case "impair":
+		// impair <id> <node> <iface> [delay=40ms] [jitter=5ms] [loss=0.5] [rate=2mbit]
+		if flag.NArg() < 4 {
+			fmt.Println("invalid usage: want \"impair\" <id> <node> <iface> [delay=…] [jitter=…] [loss=…] [rate=…]")
+			os.Exit(1)
+		}
+		settings := make(map[string]string)
+		for _, kv := range flag.Args()[4:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				fmt.Printf("invalid setting %s: want key=value\n", kv)
+				os.Exit(1)
+			}
+			settings[k] = v
+		}
+		call := lab.CallWithContext(context.TODO(), "Impair", dbus.FlagAllowInteractiveAuthorization,
+			flag.Arg(1), flag.Arg(2), flag.Arg(3), settings)
+		if call.Err != nil {
+			fmt.Println("cannot impair link:", call.Err)
+			os.Exit(1)
+		}
+	case "snapshot":
+		// snapshot save|load <id> <name>, or snapshot list <id>
+		sub := flag.Arg(1)
+		if !(sub == "list" && flag.NArg() == 3 || (sub == "save" || sub == "load") && flag.NArg() == 4) {
+			fmt.Println("invalid usage: want \"snapshot\" save|load <id> <name>, or \"snapshot\" list <id>")
+			os.Exit(1)
+		}
+		call := lab.CallWithContext(context.TODO(), "Snapshot", dbus.FlagAllowInteractiveAuthorization,
+			flag.Arg(2), sub, flag.Arg(3))
+		if call.Err != nil {
+			fmt.Printf("cannot %s snapshot: %s\n", sub, call.Err)
+			os.Exit(1)
+		}
+		fmt.Print(call.Body[0].(string))
 	case "attach":
-		call := lab.CallWithContext(context.TODO(), "Attach", 0, labdir)
+		// attach <id> <host>
+		if flag.NArg() < 3 {
+			fmt.Println("invalid usage: want \"attach\" <id> <host>")
+			os.Exit(1)
+		}
+		call := lab.CallWithContext(context.TODO(), "Attach", 0, flag.Arg(1), flag.Arg(2))
 		if call.Err != nil {
-			fmt.Println("cannot read lab status:", call.Err)
+			fmt.Println("cannot attach to host:", call.Err)
+			os.Exit(1)
+		}
+		fd, ok := call.Body[0].(dbus.UnixFD)
+		if !ok {
+			fmt.Println("invalid response from lab server")
+			os.Exit(1)
+		}
+		if err := attach(os.NewFile(uintptr(fd), flag.Arg(2))); err != nil {
+			fmt.Println("terminal error:", err)
 			os.Exit(1)
 		}
-		fmt.Println("returned fd", call.Body[0].(int))
 	case "stop":
-		call := lab.CallWithContext(context.TODO(), "Stop", dbus.FlagAllowInteractiveAuthorization)
+		// stop <id>
+		if flag.NArg() < 2 {
+			fmt.Println("invalid usage: want \"stop\" <id>")
+			os.Exit(1)
+		}
+		call := lab.CallWithContext(context.TODO(), "Stop", dbus.FlagAllowInteractiveAuthorization, flag.Arg(1))
 		if call.Err != nil {
 			fmt.Println("error stopping the lab:", call.Err)
 			os.Exit(1)
 		}
 	}
 }
+
+// labFlags returns the flags of actions loading a lab, and the lab parameters they set.
+func labFlags(action string) (*flag.FlagSet, map[string]string) {
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	params := make(map[string]string)
+	fs.Func("D", "lab parameter, as key=value (repeatable)", func(kv string) error {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("want key=value")
+		}
+		params[k] = v
+		return nil
+	})
+	return fs, params
+}
+
+// attach connects the terminal to the pty, until the remote shell exits.
+func attach(pty *os.File) error {
+	defer pty.Close()
+
+	old, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("stdin is not a terminal: %w", err)
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, &raw); err != nil {
+		return fmt.Errorf("cannot set terminal in raw mode: %w", err)
+	}
+	defer unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, old)
+
+	go io.Copy(pty, os.Stdin)
+	io.Copy(os.Stdout, pty) // returns when the shell exits
+	return nil
+}
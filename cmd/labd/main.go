@@ -1,26 +1,30 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"maps"
+	"net/netip"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TroutSoftware/labomatic"
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
 
 	"github.com/landlock-lsm/go-landlock/landlock"
-	"go.starlark.net/starlark"
-	"go.starlark.net/syntax"
 )
 
 func main() {
@@ -61,7 +65,8 @@ func main() {
 		// manage network namespaces
 		landlock.RWDirs("/run/netns"),
 		landlock.RWDirs(fmt.Sprintf("/proc/%d", os.Getpid())),
-		landlock.ROFiles("/usr/sbin/nft", "/usr/bin/resolvectl"),
+		landlock.ROFiles("/proc/meminfo"),
+		landlock.ROFiles("/usr/sbin/nft", "/usr/bin/resolvectl", "/bin/sh"),
 		landlock.RWFiles("/proc/sys/net/ipv4/ip_forward"),
 	)
 
@@ -71,107 +76,352 @@ func main() {
 }
 
 type LabServer struct {
-	ctrl chan labomatic.Controller
-
 	dbus dbus.BusObject
 
-	once sync.Mutex
+	mx   sync.Mutex
+	labs map[string]*runningLab
 }
 
-func (l *LabServer) Start(sdr dbus.Sender, labdir, workdir string) *dbus.Error {
-	l.once.Lock()
-	defer l.once.Unlock()
+// runningLab is a lab started by the server, its controller is nil while building.
+type runningLab struct {
+	*labomatic.Instance
+	hostnets []netip.Prefix
 
-	var runas user.User
-	{
-		c := l.dbus.Call("GetConnectionUnixUser", 0, sdr)
-		if c.Err != nil {
-			return dbus.MakeFailedError(fmt.Errorf("cannot identify calling user: %w", c.Err))
-		}
-		uid := c.Body[0].(uint32)
-		found, err := user.LookupId(strconv.Itoa(int(uid)))
-		if err != nil {
-			return dbus.MakeFailedError(fmt.Errorf("invalid user %d: %w", uid, err))
-		}
-		runas = *found
+	// controllers are sent under the read lock, and Stop closes ctrl under the write lock
+	mx       sync.RWMutex
+	ctrl     chan labomatic.Controller
+	stopping atomic.Bool
+}
+
+// send runs f in the lab, unless the lab is stopping.
+func (lab *runningLab) send(f labomatic.Controller) error {
+	lab.mx.RLock()
+	defer lab.mx.RUnlock()
+	if lab.stopping.Load() {
+		return fmt.Errorf("lab %s is stopping", lab.ID)
 	}
+	lab.ctrl <- f
+	return nil
+}
 
-	full := filepath.Join(labdir, "conf.star")
+// owns checks that the lab was started by u, root can act on all labs.
+func (lab *runningLab) owns(u user.User) error {
+	if u.Uid != "0" && u.Uid != lab.Owner.Uid {
+		return fmt.Errorf("lab %s belongs to %s", lab.ID, lab.Owner.Username)
+	}
+	return nil
+}
 
-	var th starlark.Thread
-	th.SetLocal("workdir", workdir)
+// caller returns the unix user of the D-Bus connection sdr.
+func (l *LabServer) caller(sdr dbus.Sender) (user.User, error) {
+	c := l.dbus.Call("GetConnectionUnixUser", 0, sdr)
+	if c.Err != nil {
+		return user.User{}, fmt.Errorf("cannot identify calling user: %w", c.Err)
+	}
+	uid := c.Body[0].(uint32)
+	found, err := user.LookupId(strconv.Itoa(int(uid)))
+	if err != nil {
+		return user.User{}, fmt.Errorf("invalid user %d: %w", uid, err)
+	}
+	return *found, nil
+}
 
-	cnf, err := starlark.ExecFileOptions(&syntax.FileOptions{
-		TopLevelControl: true,
-		Set:             true,
-		GlobalReassign:  true,
-	}, &th, full, nil, labomatic.NetBlocks)
+// running returns the lab with the given ID, once it is built.
+// l.mx must be held, and released before controllers are sent to the lab, since they can run for minutes.
+func (l *LabServer) running(id string) (*runningLab, error) {
+	lab, ok := l.labs[id]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("no lab %s running", id)
+	case lab.ctrl == nil:
+		return nil, fmt.Errorf("lab %s is still starting", id)
+	}
+	return lab, nil
+}
 
+// Start builds and runs the lab in labdir, with params available to the definition.
+// The ID of the new lab is returned, with the warnings found in the definition (one per line).
+func (l *LabServer) Start(sdr dbus.Sender, labdir, workdir string, params map[string]string) (string, string, *dbus.Error) {
+	runas, err := l.caller(sdr)
 	if err != nil {
-		return dbus.MakeFailedError(fmt.Errorf("cannot parse %s: %w", full, err))
+		return "", "", dbus.MakeFailedError(err)
+	}
+
+	full := filepath.Join(labdir, "conf.star")
+
+	cnf, diags := labomatic.Check(labdir, workdir, params)
+	if labomatic.HasErrors(diags) {
+		return "", "", dbus.MakeFailedError(fmt.Errorf("invalid lab definition:\n%s", formatDiagnostics(diags)))
+	}
+	for _, d := range diags {
+		slog.Warn(d.String())
+	}
+
+	// the host routes networks it shares with a lab, so they cannot overlap between labs
+	hostnets := labomatic.HostNetworks(cnf)
+	l.mx.Lock()
+	for _, other := range l.labs {
+		for _, pf := range hostnets {
+			if i := slices.IndexFunc(other.hostnets, pf.Overlaps); i != -1 {
+				l.mx.Unlock()
+				return "", "", dbus.MakeFailedError(fmt.Errorf("network %s overlaps network %s of lab %s, both shared with the host", pf, other.hostnets[i], other.ID))
+			}
+		}
+	}
+
+	// the smallest free ID, so that link names stay short
+	if l.labs == nil {
+		l.labs = make(map[string]*runningLab)
 	}
+	var id string
+	for i := 1; ; i++ {
+		id = strconv.Itoa(i)
+		if _, used := l.labs[id]; !used {
+			break
+		}
+	}
+	lab := &runningLab{Instance: labomatic.NewInstance(id, labdir, runas), hostnets: hostnets}
+	l.labs[id] = lab
+	l.mx.Unlock()
 
 	msg := make(chan string)
 	go func() {
 		for msg := range msg {
-			fmt.Println("message ", msg)
+			fmt.Printf("message lab%s %s\n", id, msg)
 		}
 	}()
 
+	// labs are built concurrently, and the lock is only held to register them
 	ready := make(chan chan labomatic.Controller)
-	if err := labomatic.Build(cnf, runas, msg, ready); err != nil {
-		return dbus.MakeFailedError(fmt.Errorf("cannot build %s: %w", full, err))
+	if err := labomatic.Build(lab.Instance, cnf, msg, ready); err != nil {
+		close(msg)
+		l.mx.Lock()
+		delete(l.labs, id)
+		l.mx.Unlock()
+		return "", "", dbus.MakeFailedError(fmt.Errorf("cannot build %s: %w", full, err))
 	}
-	l.ctrl = <-ready
+	ctrl := <-ready
+	// messages are only sent while building, the printer goes with the lab
+	go func() {
+		<-lab.Done()
+		close(msg)
+	}()
 
-	return nil
+	l.mx.Lock()
+	lab.ctrl = ctrl
+	l.mx.Unlock()
+	return id, formatDiagnostics(diags), nil
 }
 
-func (l *LabServer) Status() (string, *dbus.Error) {
-	l.once.Lock()
-	defer l.once.Unlock()
+// Check validates the lab definition in labdir, without building it.
+// Diagnostics are returned one per line, and the call succeeds even if there are errors.
+func (l *LabServer) Check(labdir, workdir string, params map[string]string) (string, *dbus.Error) {
+	_, diags := labomatic.Check(labdir, workdir, params)
+	return formatDiagnostics(diags), nil
+}
 
-	if l.ctrl == nil {
-		return "", nil
+func formatDiagnostics(diags []labomatic.Diagnostic) string {
+	var buf strings.Builder
+	for _, d := range diags {
+		buf.WriteString(d.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// List shows the running labs, with their owners.
+func (l *LabServer) List() (string, *dbus.Error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	var view strings.Builder
+	fmt.Fprintln(&view, "\033[1mid   owner      started   state     lab\033[0m")
+	for _, id := range slices.SortedFunc(maps.Keys(l.labs), func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b)) // numeric order
+	}) {
+		lab := l.labs[id]
+		state := "running"
+		switch {
+		case lab.ctrl == nil:
+			state = "starting"
+		case lab.stopping.Load():
+			state = "stopping"
+		}
+		fmt.Fprintf(&view, "%-4s %-10s %-9s %-9s %s\n", id, lab.Owner.Username, lab.Started.Format(time.TimeOnly), state, lab.Labdir)
+	}
+	return view.String(), nil
+}
+
+func (l *LabServer) Status(sdr dbus.Sender, id string) (string, *dbus.Error) {
+	runas, err := l.caller(sdr)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	l.mx.Lock()
+	lab, err := l.running(id)
+	l.mx.Unlock()
+	if err == nil {
+		err = lab.owns(runas)
+	}
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
 	}
 
 	var view strings.Builder
 	done := make(chan struct{})
-	l.ctrl <- labomatic.FormatTable(&view, done)
+	if err := lab.send(labomatic.FormatTable(&view, done)); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
 	<-done
 	return view.String(), nil
 }
 
-func (l *LabServer) Attach(sdr dbus.Sender, name string) (dbus.UnixFD, *dbus.Error) {
-	var runas user.User
-	{
-		c := l.dbus.Call("GetConnectionUnixUser", 0, sdr)
-		if c.Err != nil {
-			return -1, dbus.MakeFailedError(fmt.Errorf("cannot identify calling user: %w", c.Err))
-		}
-		uid := c.Body[0].(uint32)
-		found, err := user.LookupId(strconv.Itoa(int(uid)))
-		if err != nil {
-			return -1, dbus.MakeFailedError(fmt.Errorf("invalid user %d: %w", uid, err))
-		}
-		runas = *found
+func (l *LabServer) Links(sdr dbus.Sender, id string) (string, *dbus.Error) {
+	runas, err := l.caller(sdr)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	l.mx.Lock()
+	lab, err := l.running(id)
+	l.mx.Unlock()
+	if err == nil {
+		err = lab.owns(runas)
 	}
-	fd, err := labomatic.RunAsset(context.TODO(), name, runas)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	var view strings.Builder
+	done := make(chan struct{})
+	if err := lab.send(labomatic.FormatLinks(&view, done)); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	<-done
+	return view.String(), nil
+}
+
+func (l *LabServer) Impair(sdr dbus.Sender, id, node, iface string, settings map[string]string) *dbus.Error {
+	runas, err := l.caller(sdr)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+
+	l.mx.Lock()
+	lab, err := l.running(id)
+	l.mx.Unlock()
+	if err == nil {
+		err = lab.owns(runas)
+	}
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+
+	done := make(chan error)
+	if err := lab.send(labomatic.Impair(lab.Instance, node, iface, settings, done)); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	if err := <-done; err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// Snapshot saves, loads or lists (action) the snapshots of lab id.
+// The name of the snapshot is ignored when listing, and the list is returned.
+func (l *LabServer) Snapshot(sdr dbus.Sender, id, action, name string) (string, *dbus.Error) {
+	runas, err := l.caller(sdr)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	l.mx.Lock()
+	lab, err := l.running(id)
+	l.mx.Unlock()
+	if err == nil {
+		err = lab.owns(runas)
+	}
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	var (
+		view strings.Builder
+		ctrl labomatic.Controller
+	)
+	done := make(chan error)
+	switch action {
+	default:
+		return "", dbus.MakeFailedError(fmt.Errorf("unknown snapshot action %s (want save, load or list)", action))
+	case "save":
+		ctrl = labomatic.SaveSnapshot(name, done)
+	case "load":
+		ctrl = labomatic.LoadSnapshot(name, done)
+	case "list":
+		ctrl = labomatic.ListSnapshots(&view, done)
+	}
+	if err := lab.send(ctrl); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	if err := <-done; err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return view.String(), nil
+}
+
+func (l *LabServer) Attach(sdr dbus.Sender, id, name string) (dbus.UnixFD, *dbus.Error) {
+	runas, err := l.caller(sdr)
+	if err != nil {
+		return -1, dbus.MakeFailedError(err)
+	}
+
+	l.mx.Lock()
+	lab, err := l.running(id)
+	l.mx.Unlock()
+	if err == nil {
+		err = lab.owns(runas)
+	}
+	if err != nil {
+		return -1, dbus.MakeFailedError(err)
+	}
+	fd, err := labomatic.RunAsset(context.TODO(), lab.Instance, name, runas)
 	if err != nil {
 		return -1, dbus.MakeFailedError(err)
 	}
 	return dbus.UnixFD(fd), nil
 }
 
-func (l *LabServer) Stop() *dbus.Error {
-	l.once.Lock()
-	defer l.once.Unlock()
+// Stop terminates lab id, and returns once it is cleaned up.
+func (l *LabServer) Stop(sdr dbus.Sender, id string) *dbus.Error {
+	runas, err := l.caller(sdr)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
 
-	if l.ctrl != nil {
-		l.ctrl <- labomatic.TermLab
-		close(l.ctrl)
-		l.ctrl = nil
+	l.mx.Lock()
+	lab, err := l.running(id)
+	l.mx.Unlock()
+	if err == nil {
+		err = lab.owns(runas)
 	}
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	if lab.stopping.Swap(true) {
+		return dbus.MakeFailedError(fmt.Errorf("lab %s is already stopping", id))
+	}
+
+	lab.mx.Lock()
+	lab.ctrl <- labomatic.TermLab
+	close(lab.ctrl)
+	lab.mx.Unlock()
+
+	// the ID is only reused once the namespaces and nft table of the lab are removed
+	<-lab.Done()
+	l.mx.Lock()
+	delete(l.labs, id)
+	l.mx.Unlock()
 	return nil
 }
 
@@ -181,7 +431,14 @@ const intro = `
 		<method name="Start">
 			<arg direction="in" type="s"/>
 			<arg direction="in" type="s"/>
+			<arg direction="in" type="a{ss}"/>
+			<arg direction="out" type="s"/>
+			<arg direction="out" type="s"/>
 		</method>
 		<method name="Stop">
+			<arg direction="in" type="s"/>
+		</method>
+		<method name="List">
+			<arg direction="out" type="s"/>
 		</method>
 	</interface>` + introspect.IntrospectDataString + `</node> `
@@ -6,7 +6,10 @@ import (
 	"iter"
 	"log/slog"
 	"os/exec"
+	"slices"
 	"strings"
+
+	"github.com/vishvananda/netns"
 )
 
 // Controllers are used to define what commands to run on the lab
@@ -21,15 +24,22 @@ func TermLab(nss iter.Seq[RunningNode]) {
 }
 
 // Nodes are VMs or light namespaces in the current lab
-type RunningNode struct {
+type RunningNode interface {
+	Node() *netnode
+	Close() error
+}
+
+// VMNode is a node running in a QEMU virtual machine
+type VMNode struct {
 	node *netnode
 	cmd  *exec.Cmd
+	qmp  string // path of the monitor socket
 
 	donefunc func()
 }
 
-func (n RunningNode) Node() *netnode { return n.node }
-func (n RunningNode) Close() error {
+func (n VMNode) Node() *netnode { return n.node }
+func (n VMNode) Close() error {
 	if n.cmd != nil && n.cmd.Process != nil {
 		// the vm failed to start?
 		n.cmd.Process.Kill()
@@ -41,6 +51,20 @@ func (n RunningNode) Close() error {
 	return nil
 }
 
+// AssetNode is a node running directly in its own network namespace (see [NewHost]).
+type AssetNode struct {
+	node *netnode
+	ns   string // name of the network namespace
+}
+
+func (n AssetNode) Node() *netnode { return n.node }
+func (n AssetNode) Close() error {
+	if err := netns.DeleteNamed(n.ns); err != nil {
+		return fmt.Errorf("cannot delete namespace: %w", err)
+	}
+	return nil
+}
+
 func FormatTable(into io.Writer, done chan struct{}) Controller {
 	const (
 		colName = iota
@@ -59,21 +83,77 @@ func FormatTable(into io.Writer, done chan struct{}) Controller {
 
 		fmt.Fprintln(into, "\033[1mname       type       addresses\033[0m")
 
+		var dhcpds []*dhcpServer
 		for n := range s {
 			name := n.Node().name
 			typ := prettyType(n.Node().typ)
-			fmt.Fprint(into, name+strings.Repeat(" ", sizes[colName]-len(name)-1), " ")
+			// long names push the other columns, rather than being cut
+			fmt.Fprint(into, name+strings.Repeat(" ", max(sizes[colName]-len(name)-1, 0)), " ")
 			fmt.Fprint(into, " ", typ+strings.Repeat(" ", sizes[colType]-len(typ)-1), " ")
 			if len(n.Node().ifcs) > 0 {
-				addr := n.Node().ifcs[0].addr.Addr().String()
-				fmt.Fprintln(into, " "+addr)
+				fmt.Fprintln(into, " "+ifaceCell(n.Node().ifcs[0]))
 				for i := 1; i < len(n.Node().ifcs); i++ {
-					addr := n.Node().ifcs[i].addr.Addr().String()
-					fmt.Fprintln(into, "                     ", addr)
+					fmt.Fprintln(into, "                     ", ifaceCell(n.Node().ifcs[i]))
 				}
 			} else {
 				fmt.Fprintln(into, "")
 			}
+			for _, ifc := range n.Node().ifcs {
+				if ifc.net != nil && ifc.net.dhcpd != nil && !slices.Contains(dhcpds, ifc.net.dhcpd) {
+					dhcpds = append(dhcpds, ifc.net.dhcpd)
+				}
+			}
+		}
+
+		if len(dhcpds) > 0 {
+			fmt.Fprintln(into, "\n\033[1msubnet     lease           mac               expires  hostname\033[0m")
+			for _, srv := range dhcpds {
+				srv.formatLeases(into)
+			}
+		}
+		close(done)
+	}
+}
+
+// ifaceCell shows the interface address and MAC, and the kernel link once the lab is built.
+func ifaceCell(ifc *netiface) string {
+	cell := ifc.addr.Addr().String()
+	if ifc.mac.IsValid() {
+		cell = fmt.Sprintf("%-15s %s", cell, ifc.mac)
+	}
+	if ifc.link != "" {
+		cell += " (" + ifc.link + ")"
+	}
+	return cell
+}
+
+// FormatLinks writes the mapping between kernel links created for the lab, and the nodes or subnets they implement.
+func FormatLinks(into io.Writer, done chan struct{}) Controller {
+	return func(s iter.Seq[RunningNode]) {
+		fmt.Fprintln(into, "\033[1mlink       kind       lab\033[0m")
+
+		var nets []*subnet
+		for n := range s {
+			kind := "tap"
+			if n.Node().typ == nodeHost {
+				kind = "veth"
+			}
+			for _, ifc := range n.Node().ifcs {
+				fmt.Fprintf(into, "%-10s %-10s %s.%s", ifc.link, kind, n.Node().name, ifc.name)
+				if !ifc.impair.IsZero() {
+					fmt.Fprintf(into, " (%s)", ifc.impair)
+				}
+				fmt.Fprintln(into)
+				if !slices.Contains(nets, ifc.net) {
+					nets = append(nets, ifc.net)
+				}
+			}
+		}
+		for _, net := range nets {
+			fmt.Fprintf(into, "%-10s bridge     %s\n", net.link, net.name)
+			if net.hostlink != "" {
+				fmt.Fprintf(into, "%-10s host       %s\n", net.hostlink, net.name)
+			}
 		}
 		close(done)
 	}
@@ -89,5 +169,9 @@ func prettyType(t int) string {
 		return "switch"
 	case nodeAsset:
 		return "asset"
+	case nodeLinux:
+		return "linux"
+	case nodeHost:
+		return "host"
 	}
 }
@@ -15,21 +15,21 @@ func TestTableRender(t *testing.T) {
 			{addr: Addr(netip.MustParseAddr("192.0.2.1"))},
 		}}},
 		VMNode{node: &netnode{name: "r2", typ: nodeRouter, ifcs: []*netiface{
-			{addr: Addr(netip.MustParseAddr("192.0.2.2"))},
-			{addr: Addr(netip.MustParseAddr("192.0.2.3"))},
+			{addr: Addr(netip.MustParseAddr("192.0.2.2")), mac: Mac{0x52, 0x54, 0, 0xab, 0xcd, 0xef}},
+			{addr: Addr(netip.MustParseAddr("192.0.2.3")), mac: Mac{0x52, 0x54, 0, 0xab, 0xcd, 0xf0}, link: "tap2_1"},
 		}}},
 		VMNode{node: &netnode{name: "sw1", typ: nodeSwitch, ifcs: []*netiface{
 			{addr: Addr(netip.MustParseAddr("192.0.2.10"))},
 			{addr: Addr(netip.MustParseAddr("192.0.2.11"))},
 			{addr: Addr(netip.MustParseAddr("192.0.2.12"))},
 		}}},
-		(*AssetNode)(&netnode{name: "plc1", typ: nodeAsset}),
+		AssetNode{node: &netnode{name: "plc1", typ: nodeAsset}},
 	}
 
 	want := "\x1b[1mname       type       addresses\x1b[0m" + `
 r1         router     192.0.2.1
-r2         router     192.0.2.2
-                      192.0.2.3
+r2         router     192.0.2.2       52:54:00:ab:cd:ef
+                      192.0.2.3       52:54:00:ab:cd:f0 (tap2_1)
 sw1        switch     192.0.2.10
                       192.0.2.11
                       192.0.2.12
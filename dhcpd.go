@@ -0,0 +1,333 @@
+package labomatic
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"go.starlark.net/starlark"
+)
+
+// dhcpConfig is the DHCPv4 service of a host subnet, set with Subnet(dhcp=True).
+type dhcpConfig struct {
+	first, last netip.Addr // pool range, inclusive
+	options     map[int][]byte
+	reserved    map[Mac]netip.Addr
+}
+
+const leaseTime = 1 * time.Hour
+
+// newDHCPConfig validates the DHCP arguments of Subnet.
+// The default range covers the whole network, except the host address.
+func newDHCPConfig(network netip.Prefix, rg starlark.Tuple, options *starlark.Dict) (*dhcpConfig, error) {
+	cfg := &dhcpConfig{
+		options:  make(map[int][]byte),
+		reserved: make(map[Mac]netip.Addr),
+	}
+
+	switch len(rg) {
+	default:
+		return nil, fmt.Errorf("invalid range %s: want (first, last)", rg)
+	case 0:
+		cfg.first, _ = nth(network, 1)
+		cfg.last = last(network).Prev()
+	case 2:
+		for i, v := range rg {
+			var addr netip.Addr
+			switch v := v.(type) {
+			case Addr:
+				addr = v.Addr()
+			case starlark.String:
+				ad, err := netip.ParseAddr(string(v))
+				if err != nil {
+					return nil, fmt.Errorf("invalid range address %s: %w", v, err)
+				}
+				addr = ad
+			default:
+				return nil, fmt.Errorf("invalid range address %s: want Addr or string", v)
+			}
+			if !network.Contains(addr) {
+				return nil, fmt.Errorf("range address %s not in network %s", addr, network)
+			}
+			if i == 0 {
+				cfg.first = addr
+			} else {
+				cfg.last = addr
+			}
+		}
+		if cfg.last.Less(cfg.first) {
+			return nil, fmt.Errorf("invalid range: %s is after %s", cfg.first, cfg.last)
+		}
+	}
+
+	if options != nil {
+		for code, val := range options.Entries() {
+			var c int
+			if err := starlark.AsInt(code, &c); err != nil || c < 1 || c > 254 {
+				return nil, fmt.Errorf("invalid option code %s", code)
+			}
+			s, ok := starlark.AsString(val)
+			if !ok {
+				return nil, fmt.Errorf("invalid value for option %d: want an encoded option (see dhcp_options)", c)
+			}
+			enc, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for option %d: %w", c, err)
+			}
+			cfg.options[c] = enc
+		}
+	}
+	return cfg, nil
+}
+
+var reserveAddr = starlark.NewBuiltin("reserve", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	nn := fn.Receiver().(*subnet)
+	var iface, addr starlark.Value
+	if err := starlark.UnpackArgs("reserve", args, kwargs, "iface", &iface, "addr", &addr); err != nil {
+		return starlark.None, err
+	}
+	if nn.dhcp == nil {
+		return starlark.None, fmt.Errorf("reservations require a subnet with dhcp=True")
+	}
+
+	var mac Mac
+	switch v := iface.(type) {
+	case *netiface:
+		mac = v.mac
+	case Mac:
+		mac = v
+	case starlark.String:
+		m, err := ParseMac(string(v))
+		if err != nil {
+			return starlark.None, err
+		}
+		mac = m
+	default:
+		return starlark.None, fmt.Errorf("invalid interface %s: want an interface or a MAC address", iface)
+	}
+	if _, ok := nn.dhcp.reserved[mac]; ok {
+		return starlark.None, fmt.Errorf("MAC address %s already has a reservation", mac)
+	}
+
+	ad, err := nn.resolve(addr, nn.network)
+	if err != nil {
+		return starlark.None, err
+	}
+	if !nn.network.Contains(ad.Addr()) {
+		return starlark.None, fmt.Errorf("address %s not in subnet %s", ad, nn.network)
+	}
+	nn.dhcp.reserved[mac] = ad.Addr()
+	return ad, nil
+})
+
+// dhcpServer answers DHCPv4 requests on the host side of a subnet.
+type dhcpServer struct {
+	net *subnet
+	srv *server4.Server
+
+	mu     sync.Mutex
+	leases map[Mac]dhcpLease
+}
+
+type dhcpLease struct {
+	addr     netip.Addr
+	hostname string
+	expiry   time.Time
+}
+
+func newDHCPServer(net *subnet) *dhcpServer {
+	return &dhcpServer{net: net, leases: make(map[Mac]dhcpLease)}
+}
+
+// Listen starts serving on the host link of the subnet.
+// The socket is created in the current network namespace.
+func (s *dhcpServer) Listen() error {
+	srv, err := server4.NewServer(s.net.hostlink, nil, s.handle)
+	if err != nil {
+		return fmt.Errorf("cannot start DHCP server on %s: %w", s.net.hostlink, err)
+	}
+	s.srv = srv
+	go srv.Serve()
+	return nil
+}
+
+func (s *dhcpServer) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
+
+func (s *dhcpServer) handle(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	resp := s.reply(m, time.Now())
+	if resp == nil {
+		return
+	}
+	if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+		slog.Warn("cannot send DHCP reply", "subnet", s.net.name, "error", err)
+	}
+}
+
+// reply computes the answer to m, or nil if there is none.
+// Leases are recorded on acknowledgement.
+func (s *dhcpServer) reply(m *dhcpv4.DHCPv4, now time.Time) *dhcpv4.DHCPv4 {
+	if m.OpCode != dhcpv4.OpcodeBootRequest || len(m.ClientHWAddr) != 6 {
+		return nil
+	}
+	mac := Mac(m.ClientHWAddr)
+	srvaddr := last(s.net.network)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		typ  dhcpv4.MessageType
+		addr netip.Addr
+	)
+	switch m.MessageType() {
+	default:
+		return nil
+	case dhcpv4.MessageTypeRelease:
+		if l, ok := s.leases[mac]; ok && l.addr == ipaddr(m.ClientIPAddr) {
+			delete(s.leases, mac)
+		}
+		return nil
+	case dhcpv4.MessageTypeDiscover:
+		addr = s.allocate(mac, ipaddr(m.RequestedIPAddress()), now)
+		if !addr.IsValid() {
+			slog.Warn("DHCP pool exhausted", "subnet", s.net.name)
+			return nil
+		}
+		typ = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest:
+		if sid := m.ServerIdentifier(); sid != nil && !sid.Equal(srvaddr.AsSlice()) {
+			return nil // client picked another server
+		}
+		want := ipaddr(m.RequestedIPAddress())
+		if !want.IsValid() {
+			want = ipaddr(m.ClientIPAddr) // renewing
+		}
+		addr = s.allocate(mac, want, now)
+		if !addr.IsValid() || addr != want {
+			typ = dhcpv4.MessageTypeNak
+			addr = netip.Addr{}
+			break
+		}
+		typ = dhcpv4.MessageTypeAck
+		s.leases[mac] = dhcpLease{addr: addr, hostname: m.HostName(), expiry: now.Add(leaseTime)}
+	}
+
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(typ),
+		dhcpv4.WithServerIP(srvaddr.AsSlice()),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(srvaddr.AsSlice())),
+	}
+	if typ != dhcpv4.MessageTypeNak {
+		mods = append(mods,
+			dhcpv4.WithYourIP(addr.AsSlice()),
+			dhcpv4.WithNetmask(net.CIDRMask(s.net.network.Bits(), 32)),
+			dhcpv4.WithLeaseTime(uint32(leaseTime.Seconds())),
+		)
+		if s.net.nat {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRouter(srvaddr.AsSlice())))
+		}
+		if dns, err := netip.ParseAddr(s.net.dns.Server); err == nil && dns.Is4() {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDNS(dns.AsSlice())))
+		} else if s.net.zone != "" {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDNS(srvaddr.AsSlice())))
+		}
+		if s.net.dns.Domain != "" {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDomainName(s.net.dns.Domain)))
+		} else if s.net.zone != "" {
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDomainName(strings.TrimSuffix(s.net.zone, "."))))
+		}
+		for code, val := range s.net.dhcp.options {
+			mods = append(mods, dhcpv4.WithGeneric(dhcpv4.GenericOptionCode(code), val))
+		}
+	}
+
+	resp, err := dhcpv4.NewReplyFromRequest(m, mods...)
+	if err != nil {
+		slog.Warn("cannot build DHCP reply", "subnet", s.net.name, "error", err)
+		return nil
+	}
+	return resp
+}
+
+// allocate returns the address for mac: its reservation, its current lease, the requested address if free, or the first free one.
+// Interfaces attached with a static address are reserved that address.
+// An invalid address is returned if the pool is exhausted.
+func (s *dhcpServer) allocate(mac Mac, requested netip.Addr, now time.Time) netip.Addr {
+	if addr, ok := s.net.dhcp.reserved[mac]; ok {
+		return addr
+	}
+	for _, ifc := range s.net.mbs {
+		if ifc.mac == mac && ifc.addr.IsValid() {
+			return ifc.addr.Addr()
+		}
+	}
+	if l, ok := s.leases[mac]; ok {
+		return l.addr
+	}
+	if requested.IsValid() && s.free(mac, requested, now) {
+		return requested
+	}
+	for addr := s.net.dhcp.first; addr.IsValid() && !s.net.dhcp.last.Less(addr); addr = addr.Next() {
+		if s.free(mac, addr, now) {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// free reports whether addr is in the pool, and can be given to mac.
+func (s *dhcpServer) free(mac Mac, addr netip.Addr, now time.Time) bool {
+	if addr.Less(s.net.dhcp.first) || s.net.dhcp.last.Less(addr) || addr == last(s.net.network) {
+		return false
+	}
+	if s.net.inuse(addr) {
+		return false
+	}
+	for m, l := range s.leases {
+		if m != mac && l.addr == addr && now.Before(l.expiry) {
+			return false
+		}
+	}
+	return true
+}
+
+func ipaddr(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip.To4())
+	if !ok || addr.IsUnspecified() {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+// formatLeases writes the current leases of the subnet, ordered by address.
+func (s *dhcpServer) formatLeases(into io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type row struct {
+		mac Mac
+		dhcpLease
+	}
+	var rows []row
+	for mac, l := range s.leases {
+		rows = append(rows, row{mac, l})
+	}
+	slices.SortFunc(rows, func(a, b row) int { return a.addr.Compare(b.addr) })
+	for _, r := range rows {
+		fmt.Fprintf(into, "%-10s %-15s %s %s %s\n", s.net.name, r.addr, r.mac, r.expiry.Format(time.TimeOnly), r.hostname)
+	}
+}
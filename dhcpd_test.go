@@ -0,0 +1,93 @@
+package labomatic
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"go.starlark.net/starlark"
+)
+
+func TestDHCPServer(t *testing.T) {
+	const script = `
+lan = Subnet(network="192.168.10.0/24", host=True, dhcp=True, range=("192.168.10.10", "192.168.10.11"),
+             options={42: dhcp_options.ntp_servers(["192.168.10.254"])})
+r1 = Router()
+e1 = r1.attach_nic(lan, addr=lan.addr(10), mac="52:54:00:00:00:01")
+lan.reserve("52:54:00:00:00:02", "192.168.10.50")
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	srv := newDHCPServer(globals["lan"].(*subnet))
+	now := time.Now()
+
+	exchange := func(mac string) netip.Addr {
+		hw, _ := net.ParseMAC(mac)
+		disc, err := dhcpv4.NewDiscovery(hw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offer := srv.reply(disc, now)
+		if offer == nil {
+			return netip.Addr{}
+		}
+		if offer.MessageType() != dhcpv4.MessageTypeOffer {
+			t.Fatalf("%s: want offer, got %s", mac, offer.MessageType())
+		}
+		if ntp := offer.Options.Get(dhcpv4.OptionNTPServers); len(ntp) != 4 || ntp[3] != 254 {
+			t.Errorf("%s: option 42 not sent, got %v", mac, ntp)
+		}
+		req, err := dhcpv4.NewRequestFromOffer(offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack := srv.reply(req, now)
+		if ack.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("%s: want ack, got %s", mac, ack.MessageType())
+		}
+		return ipaddr(ack.YourIPAddr)
+	}
+
+	cases := []struct {
+		mac  string
+		want string
+	}{
+		{"52:54:00:00:00:01", "192.168.10.10"}, // static address
+		{"52:54:00:00:00:02", "192.168.10.50"}, // reservation
+		{"52:54:00:00:00:03", "192.168.10.11"}, // first free in range
+		{"52:54:00:00:00:03", "192.168.10.11"}, // same lease
+		{"52:54:00:00:00:04", "invalid IP"},    // exhausted
+	}
+	for _, c := range cases {
+		if got := exchange(c.mac); got.String() != c.want {
+			t.Errorf("%s: want %s, got %s", c.mac, c.want, got)
+		}
+	}
+
+	var leases strings.Builder
+	srv.formatLeases(&leases)
+	if got := strings.Count(leases.String(), "\n"); got != 3 {
+		t.Errorf("want 3 leases, got:\n%s", leases.String())
+	}
+}
+
+func TestDHCPSubnet(t *testing.T) {
+	for _, script := range []string{
+		`Subnet(network="10.0.0.0/24", dhcp=True)`,
+		`Subnet(network6="2001:db8::/64", host=True, dhcp=True)`,
+		`Subnet(network="10.0.0.0/24", host=True, range=("10.0.0.1", "10.0.0.2"))`,
+		`Subnet(network="10.0.0.0/24", host=True, dhcp=True, range=("10.0.0.9", "10.0.0.2"))`,
+		`Subnet(network="10.0.0.0/24", host=True, dhcp=True, range=("10.0.1.1", "10.0.1.2"))`,
+		`Subnet(network="10.0.0.0/24", host=True, dhcp=True, options={300: "00"})`,
+		`Subnet(network="10.0.0.0/24", host=True).reserve("52:54:00:00:00:01", "10.0.0.1")`,
+	} {
+		if _, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks); err == nil {
+			t.Errorf("%s: want error", script)
+		}
+	}
+}
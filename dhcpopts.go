@@ -1,8 +1,12 @@
 package labomatic
 
 import (
+	"encoding/hex"
 	"fmt"
+	"maps"
 	"net/netip"
+	"slices"
+	"strings"
 
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -44,13 +48,140 @@ func encodeRoutes(routes []string) ([]byte, error) {
 	return enc, nil
 }
 
+// encodeDomainSearch returns the RFC3397 encoding of a domain search list (option 119),
+// as a sequence of DNS names. Names are not compressed.
+func encodeDomainSearch(domains []string) ([]byte, error) {
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("empty domain list")
+	}
+
+	var enc []byte
+	for _, dom := range domains {
+		dom = strings.TrimSuffix(dom, ".")
+		if dom == "" {
+			return nil, fmt.Errorf("invalid empty domain")
+		}
+		for _, label := range strings.Split(dom, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain %s: labels must have 1 to 63 characters", dom)
+			}
+			enc = append(enc, byte(len(label)))
+			enc = append(enc, label...)
+		}
+		enc = append(enc, 0)
+	}
+	return enc, nil
+}
+
+// encodeAddrs returns the concatenation of IPv4 addresses, as used by server lists (e.g. option 42 for NTP).
+func encodeAddrs(addrs []string) ([]byte, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("empty address list")
+	}
+
+	var enc []byte
+	for _, a := range addrs {
+		addr, err := netip.ParseAddr(a)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid address %s: it must be an IPv4 address", a)
+		}
+		enc = append(enc, addr.AsSlice()...)
+	}
+	return enc, nil
+}
+
+// suboption is a code and its value, in vendor-specific information.
+type suboption struct {
+	code  int
+	value []byte
+}
+
+// encodeVendor returns the type-length-value encoding of vendor-specific information (option 43).
+func encodeVendor(opts []suboption) ([]byte, error) {
+	if len(opts) == 0 {
+		return nil, fmt.Errorf("empty vendor options")
+	}
+
+	var enc []byte
+	for _, o := range opts {
+		if o.code < 1 || o.code > 254 {
+			return nil, fmt.Errorf("invalid vendor option code %d", o.code)
+		}
+		if len(o.value) > 255 {
+			return nil, fmt.Errorf("vendor option %d is too long (%d bytes)", o.code, len(o.value))
+		}
+		enc = append(enc, byte(o.code), byte(len(o.value)))
+		enc = append(enc, o.value...)
+	}
+	return enc, nil
+}
+
+// routerosOptions renders options (code to hex-encoded value) as RouterOS commands.
+// Options are named opt<code>, and grouped in the option set if one is given.
+func routerosOptions(opts map[int]string, set string) (string, error) {
+	codes := slices.Sorted(maps.Keys(opts))
+
+	var buf strings.Builder
+	var names []string
+	for _, code := range codes {
+		if code < 1 || code > 254 {
+			return "", fmt.Errorf("invalid option code %d", code)
+		}
+		// values are written unquoted, and must not smuggle other commands
+		if _, err := hex.DecodeString(opts[code]); err != nil || opts[code] == "" {
+			return "", fmt.Errorf("invalid value %q for option %d: want hex-encoded bytes", opts[code], code)
+		}
+		name := fmt.Sprintf("opt%d", code)
+		fmt.Fprintf(&buf, "/ip/dhcp-server/option/add name=%s code=%d value=0x%s\n", name, code, opts[code])
+		names = append(names, name)
+	}
+	if set != "" {
+		fmt.Fprintf(&buf, "/ip/dhcp-server/option/sets/add name=%s options=%s\n", rosQuote(set), strings.Join(names, ","))
+	}
+	return buf.String(), nil
+}
+
 var dhcpOptions = &starlarkstruct.Module{
 	Name: "dhcp_options",
 	Members: starlark.StringDict{
 		"classless_routes": calcopt121,
+		"domain_search":    calcopt119,
+		"ntp_servers":      calcopt42,
+		"vendor_specific":  calcopt43,
+		"tftp_server":      textopt("tftp_server", "server"),
+		"boot_file":        textopt("boot_file", "file"),
+		"raw":              rawopt,
+		"routeros":         renderRouterOS,
 	},
 }
 
+// hexopt is the value of all encoded options, which is how RouterOS and dnsmasq take them.
+func hexopt(enc []byte) starlark.String { return starlark.String(fmt.Sprintf("%X", enc)) }
+
+// stringList reads a list of strings from a Starlark argument.
+func stringList(what string, l *starlark.List) ([]string, error) {
+	var strs []string
+	for v := range l.Elements() {
+		s, ok := starlark.AsString(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s %s: want a string", what, v)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// bytesValue reads raw option data: str and bytes are taken verbatim.
+func bytesValue(v starlark.Value) ([]byte, error) {
+	switch v := v.(type) {
+	case starlark.String:
+		return []byte(v), nil
+	case starlark.Bytes:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("invalid option value %s: want str or bytes", v)
+}
+
 var calcopt121 = starlark.NewBuiltin("classless_routes", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	routes := starlark.NewDict(1)
 	err := starlark.UnpackArgs("classless_routes", args, kwargs,
@@ -76,5 +207,120 @@ var calcopt121 = starlark.NewBuiltin("classless_routes", func(_ *starlark.Thread
 	if err != nil {
 		return starlark.None, err
 	}
-	return starlark.String(fmt.Sprintf("%X", enc)), nil
+	return hexopt(enc), nil
+})
+
+var calcopt119 = starlark.NewBuiltin("domain_search", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var domains *starlark.List
+	if err := starlark.UnpackArgs("domain_search", args, kwargs, "domains", &domains); err != nil {
+		return starlark.None, err
+	}
+	doms, err := stringList("domain", domains)
+	if err != nil {
+		return starlark.None, err
+	}
+	enc, err := encodeDomainSearch(doms)
+	if err != nil {
+		return starlark.None, err
+	}
+	return hexopt(enc), nil
+})
+
+var calcopt42 = starlark.NewBuiltin("ntp_servers", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var servers *starlark.List
+	if err := starlark.UnpackArgs("ntp_servers", args, kwargs, "servers", &servers); err != nil {
+		return starlark.None, err
+	}
+	addrs, err := stringList("server", servers)
+	if err != nil {
+		return starlark.None, err
+	}
+	enc, err := encodeAddrs(addrs)
+	if err != nil {
+		return starlark.None, err
+	}
+	return hexopt(enc), nil
+})
+
+var calcopt43 = starlark.NewBuiltin("vendor_specific", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var options *starlark.Dict
+	if err := starlark.UnpackArgs("vendor_specific", args, kwargs, "options", &options); err != nil {
+		return starlark.None, err
+	}
+
+	var subopts []suboption
+	for code, val := range options.Entries() {
+		var o suboption
+		if err := starlark.AsInt(code, &o.code); err != nil {
+			return starlark.None, fmt.Errorf("invalid vendor option code %s: %w", code, err)
+		}
+		v, err := bytesValue(val)
+		if err != nil {
+			return starlark.None, err
+		}
+		o.value = v
+		subopts = append(subopts, o)
+	}
+	enc, err := encodeVendor(subopts)
+	if err != nil {
+		return starlark.None, err
+	}
+	return hexopt(enc), nil
+})
+
+// textopt encodes options holding a single string, like the TFTP server name (option 66) or boot file (option 67).
+func textopt(name, arg string) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var text string
+		if err := starlark.UnpackArgs(name, args, kwargs, arg, &text); err != nil {
+			return starlark.None, err
+		}
+		if text == "" || len(text) > 255 {
+			return starlark.None, fmt.Errorf("invalid %s %q: want 1 to 255 characters", arg, text)
+		}
+		return hexopt([]byte(text)), nil
+	})
+}
+
+var rawopt = starlark.NewBuiltin("raw", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data starlark.Value
+	if err := starlark.UnpackArgs("raw", args, kwargs, "data", &data); err != nil {
+		return starlark.None, err
+	}
+	enc, err := bytesValue(data)
+	if err != nil {
+		return starlark.None, err
+	}
+	if len(enc) > 255 {
+		return starlark.None, fmt.Errorf("option is too long (%d bytes)", len(enc))
+	}
+	return hexopt(enc), nil
+})
+
+var renderRouterOS = starlark.NewBuiltin("routeros", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		options *starlark.Dict
+		set     string
+	)
+	if err := starlark.UnpackArgs("routeros", args, kwargs, "options", &options, "set?", &set); err != nil {
+		return starlark.None, err
+	}
+
+	opts := make(map[int]string)
+	for code, val := range options.Entries() {
+		var c int
+		if err := starlark.AsInt(code, &c); err != nil {
+			return starlark.None, fmt.Errorf("invalid option code %s: %w", code, err)
+		}
+		hex, ok := starlark.AsString(val)
+		if !ok {
+			return starlark.None, fmt.Errorf("invalid value for option %d: want an encoded option", c)
+		}
+		opts[c] = hex
+	}
+	cmds, err := routerosOptions(opts, set)
+	if err != nil {
+		return starlark.None, err
+	}
+	return starlark.String(cmds), nil
 })
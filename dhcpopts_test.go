@@ -2,7 +2,10 @@ package labomatic
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+
+	"go.starlark.net/starlark"
 )
 
 func TestEncodeRoutes(t *testing.T) {
@@ -26,3 +29,123 @@ func TestEncodeRoutes(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeDomainSearch(t *testing.T) {
+	cases := []struct {
+		domains []string
+		enc     string
+	}{
+		{[]string{"lab"}, "036C616200"},
+		{[]string{"eng.example."}, "03656E67076578616D706C6500"},
+		{[]string{"a.lab", "lab"}, "0161036C616200036C616200"},
+	}
+
+	for _, c := range cases {
+		got, err := encodeDomainSearch(c.domains)
+		if err != nil {
+			t.Errorf("invalid domains %v: %s", c.domains, err)
+		}
+		if fmt.Sprintf("%X", got) != c.enc {
+			t.Errorf("invalid encoding: want %s, got %X", c.enc, got)
+		}
+	}
+
+	for _, bad := range [][]string{nil, {""}, {"a..lab"}} {
+		if _, err := encodeDomainSearch(bad); err == nil {
+			t.Errorf("domains %q: want error", bad)
+		}
+	}
+}
+
+func TestEncodeAddrs(t *testing.T) {
+	cases := []struct {
+		addrs []string
+		enc   string
+	}{
+		{[]string{"192.0.2.1"}, "C0000201"},
+		{[]string{"192.0.2.1", "10.0.0.1"}, "C00002010A000001"},
+	}
+
+	for _, c := range cases {
+		got, err := encodeAddrs(c.addrs)
+		if err != nil {
+			t.Errorf("invalid addresses %v: %s", c.addrs, err)
+		}
+		if fmt.Sprintf("%X", got) != c.enc {
+			t.Errorf("invalid encoding: want %s, got %X", c.enc, got)
+		}
+	}
+
+	for _, bad := range [][]string{nil, {"2001:db8::1"}, {"ntp.example"}} {
+		if _, err := encodeAddrs(bad); err == nil {
+			t.Errorf("addresses %q: want error", bad)
+		}
+	}
+}
+
+func TestEncodeVendor(t *testing.T) {
+	cases := []struct {
+		opts []suboption
+		enc  string
+	}{
+		{[]suboption{{1, []byte("ab")}}, "01026162"},
+		{[]suboption{{1, []byte{0xC0, 0, 2, 1}}, {2, nil}}, "0104C00002010200"},
+	}
+
+	for _, c := range cases {
+		got, err := encodeVendor(c.opts)
+		if err != nil {
+			t.Errorf("invalid options %v: %s", c.opts, err)
+		}
+		if fmt.Sprintf("%X", got) != c.enc {
+			t.Errorf("invalid encoding: want %s, got %X", c.enc, got)
+		}
+	}
+
+	for _, bad := range [][]suboption{nil, {{0, nil}}, {{255, nil}}, {{1, make([]byte, 256)}}} {
+		if _, err := encodeVendor(bad); err == nil {
+			t.Errorf("options %v: want error", bad)
+		}
+	}
+}
+
+func TestDHCPBuiltins(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`dhcp_options.classless_routes({"default": "192.0.2.1"})`, "00C0000201"},
+		{`dhcp_options.domain_search(["lab"])`, "036C616200"},
+		{`dhcp_options.ntp_servers(["192.0.2.1"])`, "C0000201"},
+		{`dhcp_options.vendor_specific({1: "ab"})`, "01026162"},
+		{`dhcp_options.tftp_server("10.0.0.1")`, "31302E302E302E31"},
+		{`dhcp_options.boot_file("pxelinux.0")`, "7078656C696E75782E30"},
+		{`dhcp_options.raw(b"\x01\x02")`, "0102"},
+		{`dhcp_options.routeros({121: "00C0000201", 66: "31"}, set="lab")`,
+			"/ip/dhcp-server/option/add name=opt66 code=66 value=0x31\n" +
+				"/ip/dhcp-server/option/add name=opt121 code=121 value=0x00C0000201\n" +
+				"/ip/dhcp-server/option/sets/add name=lab options=opt66,opt121\n"},
+		{`dhcp_options.routeros({66: "31"}, set="lab\n/system/reset")`,
+			"/ip/dhcp-server/option/add name=opt66 code=66 value=0x31\n" +
+				"/ip/dhcp-server/option/sets/add name=\"lab\\n/system/reset\" options=opt66\n"},
+	}
+	for _, expr := range []string{
+		`dhcp_options.routeros({66: "31\n/system/reset"})`,
+		`dhcp_options.routeros({66: "3"})`,
+	} {
+		if _, err := starlark.Eval(&starlark.Thread{}, "conf.star", expr, NetBlocks); err == nil || !strings.Contains(err.Error(), "want hex-encoded bytes") {
+			t.Errorf("%s: want invalid value error, got %v", expr, err)
+		}
+	}
+
+	for _, c := range cases {
+		v, err := starlark.Eval(&starlark.Thread{}, "conf.star", c.expr, NetBlocks)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		if got, _ := starlark.AsString(v); got != c.want {
+			t.Errorf("%s: want %q, got %q", c.expr, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package labomatic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+// labZone returns the DNS zone of lab instance id in directory labdir, e.g. site1-2.lab.
+// The ID keeps zones apart when labs from directories with the same name run side by side;
+// it is left out if empty (e.g. when checking a lab before it starts).
+func labZone(labdir, id string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '-':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, filepath.Base(labdir))
+	label = strings.Trim(label, "-")
+	if label == "" || label == "." {
+		label = "default"
+	}
+	if id != "" {
+		label += "-" + id
+	}
+	return label + ".lab."
+}
+
+// dnsZone holds the authoritative records of the lab:
+// <node>.<iface>.<zone> and <node>.<zone> for all addresses, and the matching PTR records.
+type dnsZone struct {
+	origin string
+	addrs  map[string][]netip.Addr
+	ptrs   map[netip.Addr]string
+
+	// reverse zones of the lab networks (see [reverseZone]), the host resolver sends all their names here.
+	// they are answered even if there is no record, since forwarding them would loop back.
+	reverse []string
+}
+
+func newZone(origin string, nodes iter.Seq[*netnode]) *dnsZone {
+	z := &dnsZone{
+		origin: origin,
+		addrs:  make(map[string][]netip.Addr),
+		ptrs:   make(map[netip.Addr]string),
+	}
+	for node := range nodes {
+		nodename := strings.ToLower(node.name) + "." + origin
+		for _, ifc := range node.ifcs {
+			ifname := strings.ToLower(node.name+"."+ifc.name) + "." + origin
+			for _, ad := range []Addr{ifc.addr, ifc.addr6} {
+				if !ad.IsValid() {
+					continue
+				}
+				z.addrs[ifname] = append(z.addrs[ifname], ad.Addr())
+				z.addrs[nodename] = append(z.addrs[nodename], ad.Addr())
+				z.ptrs[ad.Addr()] = ifname
+			}
+			for _, pf := range []netip.Prefix{ifc.net.network, ifc.net.network6} {
+				if pf.IsValid() && !slices.Contains(z.reverse, reverseZone(pf)) {
+					z.reverse = append(z.reverse, reverseZone(pf))
+				}
+			}
+		}
+	}
+	return z
+}
+
+// reverseZone returns the in-addr.arpa or ip6.arpa domain covering pf.
+// Prefixes not on an octet (or nibble) boundary are widened.
+func reverseZone(pf netip.Prefix) string {
+	bs := pf.Masked().Addr().AsSlice()
+	var labels []string
+	if pf.Addr().Is4() {
+		for i := pf.Bits()/8 - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(bs[i]))
+		}
+		return strings.Join(append(labels, "in-addr.arpa."), ".")
+	}
+	for i := pf.Bits()/4 - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", bs[i/2]>>(4*(1-i%2))&0xf))
+	}
+	return strings.Join(append(labels, "ip6.arpa."), ".")
+}
+
+// reverseAddr parses a PTR query name back to an address.
+func reverseAddr(name string) (netip.Addr, bool) {
+	if v, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		labels := strings.Split(v, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(labels)
+		addr, err := netip.ParseAddr(strings.Join(labels, "."))
+		return addr, err == nil
+	}
+	if v, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		labels := strings.Split(v, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var bs [16]byte
+		for i, l := range labels {
+			var n byte
+			if _, err := fmt.Sscanf(l, "%1x", &n); err != nil || len(l) != 1 {
+				return netip.Addr{}, false
+			}
+			bs[15-i/2] |= n << (4 * (i % 2))
+		}
+		return netip.AddrFrom16(bs), true
+	}
+	return netip.Addr{}, false
+}
+
+// answer builds the response to the query, if it belongs to the zone.
+// Other queries are not answered (ok is false), and should be forwarded.
+func (z *dnsZone) answer(query []byte) (resp []byte, ok bool, err error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid query: %w", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid question: %w", err)
+	}
+	name := strings.ToLower(q.Name.String())
+
+	rhdr := dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+	}
+	var answers []dnsmessage.Resource
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+
+	switch {
+	case name == z.origin || strings.HasSuffix(name, "."+z.origin):
+		addrs, exists := z.addrs[name]
+		if name == z.origin {
+			exists = true
+			if q.Type == dnsmessage.TypeSOA {
+				soa, err := z.soa(z.origin)
+				if err != nil {
+					return z.servfail(hdr, q, err)
+				}
+				answers = append(answers, soa)
+			}
+		}
+		if !exists {
+			rhdr.RCode = dnsmessage.RCodeNameError
+		}
+		for _, addr := range addrs {
+			switch {
+			case addr.Is4() && q.Type == dnsmessage.TypeA:
+				rh.Type = dnsmessage.TypeA
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: addr.As4()}})
+			case addr.Is6() && q.Type == dnsmessage.TypeAAAA:
+				rh.Type = dnsmessage.TypeAAAA
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+
+	default:
+		i := slices.IndexFunc(z.reverse, func(zone string) bool { return name == zone || strings.HasSuffix(name, "."+zone) })
+		if i == -1 {
+			return nil, false, nil
+		}
+		apex := z.reverse[i]
+		addr, isptr := reverseAddr(name)
+		target, exists := z.ptrs[addr]
+		switch {
+		case name == apex:
+			if q.Type == dnsmessage.TypeSOA {
+				soa, err := z.soa(apex)
+				if err != nil {
+					return z.servfail(hdr, q, err)
+				}
+				answers = append(answers, soa)
+			}
+		case !isptr || !exists:
+			// names between the apex and the records exist, without data
+			if !z.hasReverseBelow(name) {
+				rhdr.RCode = dnsmessage.RCodeNameError
+			}
+		case q.Type == dnsmessage.TypePTR:
+			ptr, err := dnsmessage.NewName(target)
+			if err != nil {
+				return z.servfail(hdr, q, err)
+			}
+			rh.Type = dnsmessage.TypePTR
+			answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.PTRResource{PTR: ptr}})
+		}
+	}
+
+	b := dnsmessage.NewBuilder(nil, rhdr)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, rs := range answers {
+		switch body := rs.Body.(type) {
+		case *dnsmessage.AResource:
+			err = b.AResource(rs.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(rs.Header, *body)
+		case *dnsmessage.PTRResource:
+			err = b.PTRResource(rs.Header, *body)
+		case *dnsmessage.SOAResource:
+			err = b.SOAResource(rs.Header, *body)
+		}
+		if err != nil {
+			// e.g. labels longer than 63 bytes, see [dnsName]
+			return z.servfail(hdr, q, err)
+		}
+	}
+	resp, err = b.Finish()
+	if err != nil {
+		return z.servfail(hdr, q, err)
+	}
+	return resp, true, nil
+}
+
+// servfail answers the query with a server failure, when the records of the zone cannot be encoded.
+func (z *dnsZone) servfail(hdr dnsmessage.Header, q dnsmessage.Question, cause error) ([]byte, bool, error) {
+	slog.Warn("cannot answer DNS query", "name", q.Name, "error", cause)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeServerFailure,
+	})
+	b.StartQuestions()
+	b.Question(q)
+	resp, err := b.Finish()
+	return resp, true, err
+}
+
+// hasReverseBelow reports if a PTR record is under name.
+func (z *dnsZone) hasReverseBelow(name string) bool {
+	for addr := range z.ptrs {
+		if strings.HasSuffix(reverseZone(netip.PrefixFrom(addr, addr.BitLen())), "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// soa is the start of authority of zone apex, the lab zone or a reverse zone.
+func (z *dnsZone) soa(apex string) (dnsmessage.Resource, error) {
+	var names [3]dnsmessage.Name
+	for i, n := range []string{apex, "ns." + z.origin, "hostmaster." + z.origin} {
+		var err error
+		if names[i], err = dnsmessage.NewName(n); err != nil {
+			return dnsmessage.Resource{}, err
+		}
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: names[0], Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body: &dnsmessage.SOAResource{
+			NS: names[1], MBox: names[2],
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60,
+		},
+	}, nil
+}
+
+// dnsName reports if name can be encoded in DNS messages: labels of at most 63 bytes, and 255 bytes in total.
+func dnsName(name string) error {
+	if len(name) > 254 { // without the root label
+		return fmt.Errorf("name %s is longer than 255 bytes", name)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) > 63 {
+			return fmt.Errorf("label %s is longer than 63 bytes", label)
+		}
+	}
+	return nil
+}
+
+// upstreamDNS resolves queries outside of the lab zone (systemd-resolved stub).
+var upstreamDNS = "127.0.0.53:53"
+
+// dnsServer serves the lab zone on the host addresses of the lab.
+type dnsServer struct {
+	zone  *dnsZone
+	conns []net.PacketConn
+}
+
+// Listen serves on addr, port 53.
+// The socket is created in the current network namespace, and can be bound before the address is usable (e.g. during IPv6 DAD).
+func (s *dnsServer) Listen(addr netip.Addr) error {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if addr.Is4() {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+			} else {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_FREEBIND, 1)
+			}
+		})
+		return errors.Join(err, serr)
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp", netip.AddrPortFrom(addr, 53).String())
+	if err != nil {
+		return fmt.Errorf("cannot listen for DNS on %s: %w", addr, err)
+	}
+	s.conns = append(s.conns, conn)
+	go s.serve(conn)
+	return nil
+}
+
+func (s *dnsServer) serve(conn net.PacketConn) {
+	for {
+		buf := make([]byte, 1500)
+		n, peer, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			slog.Warn("cannot read DNS query", "error", err)
+			return
+		}
+
+		go func() {
+			resp, ok, err := s.zone.answer(buf[:n])
+			if err != nil {
+				slog.Debug("invalid DNS query", "peer", peer, "error", err)
+				return
+			}
+			if !ok {
+				resp, err = forward(buf[:n])
+				if err != nil {
+					slog.Debug("cannot forward DNS query", "error", err)
+					return
+				}
+			}
+			conn.WriteTo(resp, peer)
+		}()
+	}
+}
+
+// forward sends the query to the host resolver.
+func forward(query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", upstreamDNS)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *dnsServer) Close() error {
+	var errs []error
+	for _, c := range s.conns {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
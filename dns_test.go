@@ -0,0 +1,139 @@
+package labomatic
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestLabZone(t *testing.T) {
+	cases := []struct{ dir, id, zone string }{
+		{"/home/me/site1", "2", "site1-2.lab."},
+		{"/home/me/Site_B/", "12", "site-b-12.lab."},
+		{"/", "1", "default-1.lab."},
+		{"/home/me/site1", "", "site1.lab."},
+	}
+	for _, c := range cases {
+		if got := labZone(c.dir, c.id); got != c.zone {
+			t.Errorf("labZone(%s, %s): want %s, got %s", c.dir, c.id, c.zone, got)
+		}
+	}
+}
+
+func TestReverseZone(t *testing.T) {
+	cases := []struct{ pf, zone string }{
+		{"192.168.10.0/24", "10.168.192.in-addr.arpa."},
+		{"10.0.0.0/8", "10.in-addr.arpa."},
+		{"172.16.0.0/12", "172.in-addr.arpa."},
+		{"2001:db8::/32", "8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, c := range cases {
+		if got := reverseZone(netip.MustParsePrefix(c.pf)); got != c.zone {
+			t.Errorf("reverseZone(%s): want %s, got %s", c.pf, c.zone, got)
+		}
+	}
+
+	for _, a := range []string{"192.168.10.3", "2001:db8::a:1"} {
+		addr := netip.MustParseAddr(a)
+		name := reverseZone(netip.PrefixFrom(addr, addr.BitLen()))
+		if got, ok := reverseAddr(name); !ok || got != addr {
+			t.Errorf("reverseAddr(%s): want %s, got %s", name, addr, got)
+		}
+	}
+}
+
+func TestZoneAnswer(t *testing.T) {
+	script := `
+lan = Subnet(network="192.168.10.0/24", network6="2001:db8::/64")
+r1 = Router()
+r1.attach_nic(lan, addr=lan.addr(1), addr6=lan.addr6(1))
+r1.attach_nic(lan, addr=lan.addr(2))
+r2 = Router(name="r2-` + strings.Repeat("x", 64) + `")
+r2.attach_nic(lan, addr=lan.addr(3))
+wide = Subnet(network="10.1.2.0/23")
+r3 = Router(name="r3")
+r3.attach_nic(wide, addr=wide.addr(1))
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	z := newZone("site1.lab.", nodesof(globals, OfType(nodeRouter)))
+
+	cases := []struct {
+		name    string
+		typ     dnsmessage.Type
+		handled bool
+		rcode   dnsmessage.RCode
+		answers []string
+	}{
+		{"r1.ether2.site1.lab.", dnsmessage.TypeA, true, dnsmessage.RCodeSuccess, []string{"192.168.10.1"}},
+		{"R1.Ether2.site1.lab.", dnsmessage.TypeAAAA, true, dnsmessage.RCodeSuccess, []string{"2001:db8::1"}},
+		{"r1.site1.lab.", dnsmessage.TypeA, true, dnsmessage.RCodeSuccess, []string{"192.168.10.1", "192.168.10.2"}},
+		{"r1.ether3.site1.lab.", dnsmessage.TypeAAAA, true, dnsmessage.RCodeSuccess, nil},
+		{"r2.site1.lab.", dnsmessage.TypeA, true, dnsmessage.RCodeNameError, nil},
+		{"2.10.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, dnsmessage.RCodeSuccess, []string{"r1.ether3.site1.lab."}},
+		{"9.10.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, dnsmessage.RCodeNameError, nil},
+		{"3.10.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, dnsmessage.RCodeServerFailure, nil},
+		{"1.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, false, 0, nil},
+		// the reverse zones are routed here by the host resolver, forwarding would loop
+		{"10.168.192.in-addr.arpa.", dnsmessage.TypeSOA, true, dnsmessage.RCodeSuccess, []string{"10.168.192.in-addr.arpa."}},
+		{"10.168.192.in-addr.arpa.", dnsmessage.TypeNS, true, dnsmessage.RCodeSuccess, nil},
+		{"x.10.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, dnsmessage.RCodeNameError, nil},
+		{"5.9.1.10.in-addr.arpa.", dnsmessage.TypePTR, true, dnsmessage.RCodeNameError, nil},
+		{"2.1.10.in-addr.arpa.", dnsmessage.TypeNS, true, dnsmessage.RCodeSuccess, nil},
+		{"1.2.1.10.in-addr.arpa.", dnsmessage.TypePTR, true, dnsmessage.RCodeSuccess, []string{"r3.ether2.site1.lab."}},
+		{"example.com.", dnsmessage.TypeA, false, 0, nil},
+	}
+
+	for _, c := range cases {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(c.name), Type: c.typ, Class: dnsmessage.ClassINET})
+		query, _ := b.Finish()
+
+		resp, ok, err := z.answer(query)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if ok != c.handled {
+			t.Errorf("%s: want handled=%t", c.name, c.handled)
+		}
+		if !ok {
+			continue
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatalf("%s: invalid response: %s", c.name, err)
+		}
+		if msg.ID != 42 || !msg.Authoritative || msg.RCode != c.rcode {
+			t.Errorf("%s: invalid header %+v", c.name, msg.Header)
+		}
+		var got []string
+		for _, rs := range msg.Answers {
+			switch body := rs.Body.(type) {
+			case *dnsmessage.AResource:
+				got = append(got, netip.AddrFrom4(body.A).String())
+			case *dnsmessage.AAAAResource:
+				got = append(got, netip.AddrFrom16(body.AAAA).String())
+			case *dnsmessage.PTRResource:
+				got = append(got, body.PTR.String())
+			case *dnsmessage.SOAResource:
+				got = append(got, rs.Header.Name.String())
+			}
+		}
+		if len(got) != len(c.answers) {
+			t.Errorf("%s: want %v, got %v", c.name, c.answers, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.answers[i] {
+				t.Errorf("%s: want %v, got %v", c.name, c.answers, got)
+			}
+		}
+	}
+}
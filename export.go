@@ -0,0 +1,190 @@
+package labomatic
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// Topology is the model of a lab, as exported to JSON.
+// Nodes and subnets are sorted by name, interfaces are in attachment order.
+// Fields are only added to the model, never renamed or removed.
+type Topology struct {
+	Nodes   []TopologyNode   `json:"nodes"`
+	Subnets []TopologySubnet `json:"subnets"`
+}
+
+// TopologyNode is a node of the lab.
+type TopologyNode struct {
+	Name string `json:"name"`
+	// one of router, switch, asset, linux, host
+	Type  string `json:"type"`
+	Image string `json:"image,omitempty"`
+	// resources of VMs, unset for host nodes
+	CPUs       int                 `json:"cpus,omitempty"`
+	Memory     int                 `json:"memory_mib,omitempty"`
+	Interfaces []TopologyInterface `json:"interfaces"`
+}
+
+// TopologyInterface is a network interface of a node, attached to a subnet.
+type TopologyInterface struct {
+	Name   string `json:"name"`
+	Subnet string `json:"subnet"`
+	MAC    string `json:"mac"`
+	// static addresses, without prefix length
+	Address  string `json:"address,omitempty"`
+	Address6 string `json:"address6,omitempty"`
+	// VLAN port configuration, on vlan_filtering subnets
+	VLAN   int   `json:"vlan,omitempty"`
+	Trunk  []int `json:"trunk,omitempty"`
+	Native int   `json:"native,omitempty"`
+}
+
+// TopologySubnet is a network segment of the lab.
+type TopologySubnet struct {
+	Name     string `json:"name"`
+	Network  string `json:"network,omitempty"`
+	Network6 string `json:"network6,omitempty"`
+	// the host is attached to the subnet, with the last address
+	Host bool `json:"host"`
+	// traffic from the subnet is masqueraded by the host
+	NAT           bool         `json:"nat"`
+	LinkOnly      bool         `json:"link_only"`
+	VLANFiltering bool         `json:"vlan_filtering"`
+	DHCP          bool         `json:"dhcp"`
+	DNS           *TopologyDNS `json:"dns,omitempty"`
+}
+
+// TopologyDNS is the resolver configured on the host side of a subnet.
+type TopologyDNS struct {
+	Server string `json:"server"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// NewTopology builds the model of the lab defined by globals.
+func NewTopology(globals starlark.StringDict) Topology {
+	tp := Topology{Nodes: []TopologyNode{}, Subnets: []TopologySubnet{}}
+	for node := range nodesof(globals, OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter), OfType(nodeLinux), OfType(nodeHost)) {
+		tn := TopologyNode{
+			Name:       node.name,
+			Type:       prettyType(node.typ),
+			Image:      node.image,
+			Interfaces: []TopologyInterface{},
+		}
+		if node.typ != nodeHost {
+			tn.CPUs, tn.Memory = node.res.cpus, int(node.res.memory)
+		}
+		for _, ifc := range node.ifcs {
+			ti := TopologyInterface{
+				Name:   ifc.name,
+				Subnet: ifc.net.name,
+				MAC:    ifc.mac.String(),
+				VLAN:   ifc.vlans.access,
+				Trunk:  ifc.vlans.trunk,
+				Native: ifc.vlans.native,
+			}
+			if ifc.addr.IsValid() {
+				ti.Address = ifc.addr.String()
+			}
+			if ifc.addr6.IsValid() {
+				ti.Address6 = ifc.addr6.String()
+			}
+			tn.Interfaces = append(tn.Interfaces, ti)
+		}
+		tp.Nodes = append(tp.Nodes, tn)
+	}
+
+	for net := range netsof(globals) {
+		ts := TopologySubnet{
+			Name:          net.name,
+			Host:          net.host,
+			NAT:           net.nat,
+			LinkOnly:      net.linkonly,
+			VLANFiltering: net.vlanfiltering,
+			DHCP:          net.dhcp != nil,
+		}
+		if net.network.IsValid() {
+			ts.Network = net.network.String()
+		}
+		if net.network6.IsValid() {
+			ts.Network6 = net.network6.String()
+		}
+		if net.dns.Server != "" {
+			ts.DNS = &TopologyDNS{Server: net.dns.Server, Domain: net.dns.Domain}
+		}
+		tp.Subnets = append(tp.Subnets, ts)
+	}
+
+	slices.SortFunc(tp.Nodes, func(a, b TopologyNode) int { return cmp.Compare(a.Name, b.Name) })
+	slices.SortFunc(tp.Subnets, func(a, b TopologySubnet) int { return cmp.Compare(a.Name, b.Name) })
+	return tp
+}
+
+// Export writes the lab defined by globals in format, either json (see [Topology]) or dot (Graphviz).
+func Export(into io.Writer, globals starlark.StringDict, format string) error {
+	tp := NewTopology(globals)
+	switch format {
+	default:
+		return fmt.Errorf("unknown export format %q (want dot or json)", format)
+	case "json":
+		enc := json.NewEncoder(into)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tp)
+	case "dot":
+		return writeDOT(into, tp)
+	}
+}
+
+var dotShapes = map[string]string{
+	"router": "box3d",
+	"switch": "box",
+	"asset":  "ellipse",
+	"linux":  "component",
+	"host":   "house",
+}
+
+// writeDOT draws nodes by type, and subnets as hubs, with the addresses on the edges.
+func writeDOT(into io.Writer, tp Topology) error {
+	var buf strings.Builder
+	buf.WriteString("graph lab {\n")
+	buf.WriteString("\tnode [fontname=\"sans-serif\"];\n\tedge [fontname=\"sans-serif\", fontsize=10];\n\n")
+
+	for _, sn := range tp.Subnets {
+		label := []string{sn.Name}
+		for _, pf := range []string{sn.Network, sn.Network6} {
+			if pf != "" {
+				label = append(label, pf)
+			}
+		}
+		switch {
+		case sn.NAT:
+			label = append(label, "(NAT)")
+		case sn.Host:
+			label = append(label, "(host)")
+		}
+		fmt.Fprintf(&buf, "\t%q [shape=ellipse, style=filled, fillcolor=lightgrey, label=%q];\n", sn.Name, strings.Join(label, "\n"))
+	}
+	buf.WriteString("\n")
+
+	for _, n := range tp.Nodes {
+		fmt.Fprintf(&buf, "\t%q [shape=%s, label=%q];\n", n.Name, dotShapes[n.Type], n.Name+"\n"+n.Type)
+		for _, ifc := range n.Interfaces {
+			label := []string{ifc.Name}
+			for _, ad := range []string{ifc.Address, ifc.Address6} {
+				if ad != "" {
+					label = append(label, ad)
+				}
+			}
+			fmt.Fprintf(&buf, "\t%q -- %q [label=%q];\n", n.Name, ifc.Subnet, strings.Join(label, "\n"))
+		}
+	}
+	buf.WriteString("}\n")
+
+	_, err := io.WriteString(into, buf.String())
+	return err
+}
@@ -0,0 +1,85 @@
+package labomatic
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestExport(t *testing.T) {
+	const script = `
+lan = Subnet(network="192.168.10.0/24", network6="2001:db8::/64", host=True, dns_server="192.0.2.53")
+wan = Outnet()
+r1 = Router()
+r1.attach_nic(wan, addr=wan.addr(2))
+r1.attach_nic(lan, addr=lan.addr(1), addr6=lan.addr6(1))
+h1 = Host()
+h1.attach_nic(lan, addr=lan.addr(10))
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+
+	var out strings.Builder
+	if err := Export(&out, globals, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var tp Topology
+	if err := json.Unmarshal([]byte(out.String()), &tp); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	if !reflect.DeepEqual(tp, NewTopology(globals)) {
+		t.Errorf("JSON does not round-trip:\n%s", out.String())
+	}
+
+	var names []string
+	for _, n := range tp.Nodes {
+		names = append(names, n.Name+":"+n.Type)
+	}
+	if got := strings.Join(names, " "); got != "h1:host r1:router" {
+		t.Errorf("nodes: want h1:host r1:router, got %s", got)
+	}
+	r1 := tp.Nodes[1]
+	if len(r1.Interfaces) != 2 || r1.Interfaces[1].Address != "192.168.10.1" || r1.Interfaces[1].Address6 != "2001:db8::1" {
+		t.Errorf("r1 interfaces: got %+v", r1.Interfaces)
+	}
+	if len(tp.Subnets) != 2 {
+		t.Fatalf("want 2 subnets, got %+v", tp.Subnets)
+	}
+	for _, sn := range tp.Subnets {
+		switch sn.Network {
+		case "192.168.10.0/24":
+			if !sn.Host || sn.NAT || sn.DNS == nil || sn.DNS.Server != "192.0.2.53" {
+				t.Errorf("lan: got %+v", sn)
+			}
+		default:
+			if !sn.NAT {
+				t.Errorf("wan: want NAT, got %+v", sn)
+			}
+		}
+	}
+
+	out.Reset()
+	if err := Export(&out, globals, "dot"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"graph lab {",
+		`"r1" [shape=box3d, label="r1\nrouter"];`,
+		`"h1" [shape=house, label="h1\nhost"];`,
+		`"r1" -- "` + tp.Subnets[0].Name + `"`,
+		`label="ether3\n192.168.10.1\n2001:db8::1"`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("DOT output lacks %s:\n%s", want, out.String())
+		}
+	}
+
+	if err := Export(&out, globals, "svg"); err == nil {
+		t.Error("want error on unknown format")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/TroutSoftware/labomatic
 
-go 1.23
+go 1.24
 
 require (
 	github.com/godbus/dbus/v5 v5.1.0
@@ -11,12 +11,10 @@ require (
 	go.starlark.net v0.0.0-20240725214946-42030a7cedce
 	golang.org/x/crypto v0.27.0
 	golang.org/x/sys v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	kernel.org/pub/linux/libs/security/libcap/psx v1.2.70 // indirect
-)
+require kernel.org/pub/linux/libs/security/libcap/psx v1.2.70 // indirect
 
 require (
 	github.com/creack/pty/v2 v2.0.1
@@ -26,7 +24,7 @@ require (
 	github.com/mdlayher/socket v0.5.1 // indirect
 	github.com/pierrec/lz4/v4 v4.1.21 // indirect
 	github.com/u-root/uio v0.0.0-20240224005618-d2acac8f3701 // indirect
-	golang.org/x/net v0.29.0 // indirect
+	golang.org/x/net v0.29.0
 	golang.org/x/sync v0.8.0 // indirect
 )
 
@@ -0,0 +1,229 @@
+package labomatic
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.starlark.net/starlark"
+	"golang.org/x/sys/unix"
+)
+
+// impairment degrades the link of an interface, to simulate slow or lossy networks.
+// It is installed as a netem qdisc on the lab side of the interface,
+// and therefore applies to the traffic sent towards the node.
+// The rate is limited by netem itself rather than a tbf child qdisc: netem delays packets to fit the rate,
+// which is what a slow link does, and a single qdisc keeps delay and rate consistent when changed at runtime.
+type impairment struct {
+	delay  time.Duration
+	jitter time.Duration
+	loss   float64 // in %
+	rate   uint64  // in bit/s, 0 is unlimited
+}
+
+func (im impairment) IsZero() bool { return im == impairment{} }
+
+func (im impairment) String() string {
+	if im.IsZero() {
+		return "none"
+	}
+	var parts []string
+	if im.delay > 0 {
+		parts = append(parts, "delay="+im.delay.String())
+	}
+	if im.jitter > 0 {
+		parts = append(parts, "jitter="+im.jitter.String())
+	}
+	if im.loss > 0 {
+		parts = append(parts, fmt.Sprintf("loss=%g%%", im.loss))
+	}
+	if im.rate > 0 {
+		parts = append(parts, fmt.Sprintf("rate=%dbit", im.rate))
+	}
+	return strings.Join(parts, " ")
+}
+
+// newImpairment validates impairment settings, all optional.
+func newImpairment(delay, jitter string, loss float64, rate string) (impairment, error) {
+	var (
+		im  impairment
+		err error
+	)
+	if delay != "" {
+		if im.delay, err = time.ParseDuration(delay); err != nil || im.delay < 0 {
+			return im, fmt.Errorf("invalid delay %q", delay)
+		}
+	}
+	if jitter != "" {
+		if im.jitter, err = time.ParseDuration(jitter); err != nil || im.jitter < 0 {
+			return im, fmt.Errorf("invalid jitter %q", jitter)
+		}
+		if im.delay == 0 {
+			return im, errors.New("jitter requires a delay")
+		}
+	}
+	if loss < 0 || loss > 100 {
+		return im, fmt.Errorf("invalid loss %g (want a percentage)", loss)
+	}
+	im.loss = loss
+	if rate != "" {
+		if im.rate, err = parseRate(rate); err != nil {
+			return im, err
+		}
+	}
+	return im, nil
+}
+
+// parseRate reads a rate in bit/s, with the units used by tc (bit, kbit, mbit, gbit).
+func parseRate(s string) (uint64, error) {
+	num, unit := s, uint64(1)
+	for _, u := range []struct {
+		sfx  string
+		mult uint64
+	}{{"kbit", 1e3}, {"mbit", 1e6}, {"gbit", 1e9}, {"bit", 1}} {
+		if v, ok := strings.CutSuffix(strings.ToLower(s), u.sfx); ok {
+			num, unit = v, u.mult
+			break
+		}
+	}
+	r, err := strconv.ParseFloat(num, 64)
+	if err != nil || r <= 0 {
+		return 0, fmt.Errorf("invalid rate %q (want e.g. 2mbit)", s)
+	}
+	return uint64(r * float64(unit)), nil
+}
+
+// unpackImpairment reads the impairment keyword arguments of attach_nic.
+func unpackImpairment(delay, jitter string, loss starlark.Value, rate string) (impairment, error) {
+	var fl float64
+	if loss != nil {
+		f, ok := starlark.AsFloat(loss)
+		if !ok {
+			return impairment{}, fmt.Errorf("invalid loss %s: want a number", loss)
+		}
+		fl = f
+	}
+	return newImpairment(delay, jitter, fl, rate)
+}
+
+// apply replaces the qdisc of link to match the impairment.
+// A zero impairment removes any existing one.
+func (im impairment) apply(lk *netlink.Handle, link netlink.Link) error {
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	}
+	if im.IsZero() {
+		err := lk.QdiscDel(&netlink.GenericQdisc{QdiscAttrs: attrs, QdiscType: "netem"})
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+			return nil // nothing installed
+		}
+		return err
+	}
+
+	return lk.QdiscReplace(netlink.NewNetem(attrs, netlink.NetemQdiscAttrs{
+		Latency: uint32(im.delay.Microseconds()),
+		Jitter:  uint32(im.jitter.Microseconds()),
+		Loss:    float32(im.loss),
+		Rate64:  im.rate / 8, // netem works in bytes
+	}))
+}
+
+// Impair changes the impairment of interface iface on node of lab at runtime.
+// Settings are delay, jitter, loss and rate, as in attach_nic, and change only those parameters of the current impairment;
+// a setting to 0 removes that parameter, and no settings at all remove the impairment.
+// The result is sent to done.
+func Impair(lab *Instance, node, iface string, settings map[string]string, done chan<- error) Controller {
+	return func(s iter.Seq[RunningNode]) {
+		done <- impair(lab, s, node, iface, settings)
+	}
+}
+
+// update returns the impairment with the given settings changed, see [Impair].
+func (im impairment) update(settings map[string]string) (impairment, error) {
+	if len(settings) == 0 {
+		return impairment{}, nil
+	}
+
+	var delay, jitter, rate string
+	if im.delay > 0 {
+		delay = im.delay.String()
+	}
+	if im.jitter > 0 {
+		jitter = im.jitter.String()
+	}
+	if im.rate > 0 {
+		rate = fmt.Sprintf("%dbit", im.rate)
+	}
+	loss := im.loss
+	for k, v := range settings {
+		if v == "0" {
+			v = ""
+		}
+		switch k {
+		default:
+			return im, fmt.Errorf("unknown impairment %s (want delay, jitter, loss or rate)", k)
+		case "delay":
+			delay = v
+		case "jitter":
+			jitter = v
+		case "rate":
+			rate = v
+		case "loss":
+			loss = 0
+			if v != "" {
+				var err error
+				if loss, err = strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64); err != nil {
+					return im, fmt.Errorf("invalid loss %q", v)
+				}
+			}
+		}
+	}
+	return newImpairment(delay, jitter, loss, rate)
+}
+
+func impair(lab *Instance, s iter.Seq[RunningNode], node, iface string, settings map[string]string) error {
+	for n := range s {
+		if n.Node().name != node {
+			continue
+		}
+		for _, ifc := range n.Node().ifcs {
+			if ifc.name != iface {
+				continue
+			}
+
+			ns, err := netns.GetFromName(lab.netns())
+			if err != nil {
+				return fmt.Errorf("cannot open lab namespace: %w", err)
+			}
+			defer ns.Close()
+			lk, err := netlink.NewHandleAt(ns)
+			if err != nil {
+				return fmt.Errorf("obtaining netlink handle: %w", err)
+			}
+			defer lk.Close()
+
+			im, err := ifc.impair.update(settings)
+			if err != nil {
+				return err
+			}
+			link, err := lk.LinkByName(ifc.link)
+			if err != nil {
+				return fmt.Errorf("cannot find link %s: %w", ifc.link, err)
+			}
+			if err := im.apply(lk, link); err != nil {
+				return fmt.Errorf("cannot set impairment on %s: %w", ifc.link, err)
+			}
+			ifc.impair = im
+			return nil
+		}
+		return fmt.Errorf("no interface %s on node %s", iface, node)
+	}
+	return fmt.Errorf("no such node %s", node)
+}
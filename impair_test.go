@@ -0,0 +1,66 @@
+package labomatic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImpairment(t *testing.T) {
+	cases := []struct {
+		delay, jitter string
+		loss          float64
+		rate          string
+		want          impairment
+		err           bool
+	}{
+		{"40ms", "5ms", 0.5, "2mbit", impairment{40 * time.Millisecond, 5 * time.Millisecond, 0.5, 2e6}, false},
+		{"", "", 0, "512kbit", impairment{rate: 512e3}, false},
+		{"", "", 0, "100bit", impairment{rate: 100}, false},
+		{"", "", 0, "1.5gbit", impairment{rate: 1.5e9}, false},
+		{"", "5ms", 0, "", impairment{}, true},
+		{"forty", "", 0, "", impairment{}, true},
+		{"", "", 101, "", impairment{}, true},
+		{"", "", 0, "fast", impairment{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := newImpairment(c.delay, c.jitter, c.loss, c.rate)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%+v: want error, got %s", c, got)
+		case !c.err && err != nil:
+			t.Errorf("%+v: unexpected error %s", c, err)
+		case !c.err && got != c.want:
+			t.Errorf("%+v: want %s, got %s", c, c.want, got)
+		}
+	}
+}
+
+func TestImpairmentUpdate(t *testing.T) {
+	base := impairment{delay: 40 * time.Millisecond, jitter: 5 * time.Millisecond, rate: 2e6}
+	cases := []struct {
+		settings map[string]string
+		want     impairment
+		err      bool
+	}{
+		{map[string]string{"loss": "1"}, impairment{40 * time.Millisecond, 5 * time.Millisecond, 1, 2e6}, false},
+		{map[string]string{"rate": "0"}, impairment{delay: 40 * time.Millisecond, jitter: 5 * time.Millisecond}, false},
+		{map[string]string{"delay": "10ms"}, impairment{10 * time.Millisecond, 5 * time.Millisecond, 0, 2e6}, false},
+		{map[string]string{"jitter": "0", "delay": "0"}, impairment{rate: 2e6}, false},
+		{nil, impairment{}, false},
+		{map[string]string{"delay": "0"}, impairment{}, true}, // jitter left without delay
+		{map[string]string{"burst": "1"}, impairment{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := base.update(c.settings)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%v: want error, got %s", c.settings, got)
+		case !c.err && err != nil:
+			t.Errorf("%v: unexpected error %s", c.settings, err)
+		case !c.err && got != c.want:
+			t.Errorf("%v: want %s, got %s", c.settings, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package labomatic
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Instance is a lab running on the host.
+// Several labs can run side by side: the network namespaces, nft table, links in the host namespace
+// and temporary files are all named after the ID, which must be short to fit in link names (e.g. "3").
+type Instance struct {
+	ID      string
+	Labdir  string
+	Owner   user.User
+	Started time.Time
+
+	// TmpDir holds the disks and seeds of the VMs, set in Build.
+	TmpDir string
+
+	mx     sync.Mutex
+	telnet int // last port allocated to a guest agent
+
+	done chan struct{}
+}
+
+// NewInstance returns the instance id of the lab in labdir, started by owner.
+func NewInstance(id, labdir string, owner user.User) *Instance {
+	return &Instance{ID: id, Labdir: labdir, Owner: owner, Started: time.Now(), telnet: 23, done: make(chan struct{})}
+}
+
+// Done is closed once the lab is cleaned up: the network namespaces, nft table and temporary files are removed,
+// and the ID can be reused.
+// This happens when Build fails, or after the controller channel returned by Build is closed.
+func (in *Instance) Done() <-chan struct{} { return in.done }
+
+// netns is the name of the network namespace holding the bridges and VMs of the lab.
+func (in *Instance) netns() string { return "lab" + in.ID }
+
+// hostns is the name of the network namespace of host node name
+func (in *Instance) hostns(name string) string { return fmt.Sprintf("lab%s-%s", in.ID, name) }
+
+// monitor is the path of the QMP monitor socket of the nnode-th VM.
+// Sockets are named after the index, since node names can exceed the length of unix socket paths (108 bytes).
+func (in *Instance) monitor(nnode int) string {
+	return filepath.Join(in.TmpDir, fmt.Sprintf("vm%d.qmp", nnode))
+}
+
+// nftTable is the name of the nft table masquerading the NATed subnets.
+func (in *Instance) nftTable() string { return "labomatic_" + in.ID }
+
+// nextTelnet allocates the port of the guest agent of a new VM.
+// Ports are bound in the lab namespace, so only need to be unique in a lab.
+func (in *Instance) nextTelnet() int {
+	in.mx.Lock()
+	defer in.mx.Unlock()
+	in.telnet++
+	return in.telnet
+}
@@ -0,0 +1,36 @@
+package labomatic
+
+import (
+	"os/user"
+	"strings"
+	"testing"
+)
+
+func TestInstanceNames(t *testing.T) {
+	a, b := NewInstance("1", "/home/a/site1", user.User{}), NewInstance("12", "/home/b/site1", user.User{})
+	if a.netns() == b.netns() || a.hostns("pc1") == b.hostns("pc1") || a.nftTable() == b.nftTable() {
+		t.Errorf("labs share kernel names: %s, %s, %s", a.netns(), a.hostns("pc1"), a.nftTable())
+	}
+	if a.hostns("pc1") == b.netns() {
+		t.Errorf("host namespace %s is also the lab namespace of %s", a.hostns("pc1"), b.ID)
+	}
+
+	var rules strings.Builder
+	if err := masquerade_rule.Execute(&rules, struct {
+		Table      string
+		Interfaces []string
+	}{b.nftTable(), []string{"lab12_1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rules.String(), "delete table inet labomatic_12\n") || strings.Contains(rules.String(), "inet labomatic ") {
+		t.Errorf("nft rules not scoped to the lab:\n%s", rules.String())
+	}
+
+	if p1, p2, p3 := a.nextTelnet(), a.nextTelnet(), b.nextTelnet(); p1 == p2 || p3 != p1 {
+		t.Errorf("want agent ports allocated per lab, got %d and %d in lab 1, %d in lab 12", p1, p2, p3)
+	}
+	a.TmpDir = "/tmp/labomatic_1_123456789"
+	if got := a.monitor(12); got != "/tmp/labomatic_1_123456789/vm12.qmp" {
+		t.Errorf("monitor socket not named after the node index: %s", got)
+	}
+}
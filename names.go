@@ -0,0 +1,103 @@
+package labomatic
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// labnames is the registry of node and subnet names in a lab definition.
+// It is stored as a thread local, so every load of a configuration (which runs in a new thread) starts afresh,
+// and generated names are stable across restarts of the same lab.
+type labnames struct {
+	used  map[string]syntax.Position
+	count map[string]int // next candidate, per prefix
+	macs  map[Mac]syntax.Position
+}
+
+const labnamesKey = "labomatic.names"
+
+func namesof(th *starlark.Thread) *labnames {
+	nm, ok := th.Local(labnamesKey).(*labnames)
+	if !ok {
+		nm = &labnames{
+			used:  make(map[string]syntax.Position),
+			count: make(map[string]int),
+			macs:  make(map[Mac]syntax.Position),
+		}
+		th.SetLocal(labnamesKey, nm)
+	}
+	return nm
+}
+
+// allocName registers name in the lab, returning an error if it is already in use.
+// If name is empty, a new one is generated as prefix followed by the first free index.
+func allocName(th *starlark.Thread, name, prefix string) (string, error) {
+	nm := namesof(th)
+
+	var pos syntax.Position
+	if th.CallStackDepth() > 1 {
+		pos = th.CallFrame(1).Pos
+	}
+
+	if name == "" {
+		n := max(nm.count[prefix], 1)
+		for {
+			name = fmt.Sprintf("%s%d", prefix, n)
+			n++
+			if _, used := nm.used[name]; !used {
+				break
+			}
+		}
+		nm.count[prefix] = n
+	} else if first, used := nm.used[name]; used {
+		return "", fmt.Errorf("name %s already used at %s", name, first)
+	} else if strings.ContainsFunc(name, invalidNameChar) {
+		return "", fmt.Errorf("invalid name %q: only letters, digits, '.', '-' and '_' are allowed", name)
+	}
+
+	nm.used[name] = pos
+	return name, nil
+}
+
+// allocMac registers mac in the lab, returning an error if it is already in use.
+// If mac is not set, a stable address is derived from the lab, node and interface index.
+func allocMac(th *starlark.Thread, mac Mac, node string, index int) (Mac, error) {
+	nm := namesof(th)
+
+	var pos syntax.Position
+	if th.CallStackDepth() > 1 {
+		pos = th.CallFrame(1).Pos
+	}
+
+	if !mac.IsValid() {
+		lab, _ := th.Local("labdir").(string)
+		// on the rare collision, derive again
+		for seq := 0; ; seq++ {
+			h := sha256.Sum256(fmt.Appendf(nil, "%s\x00%s\x00%d\x00%d", filepath.Base(lab), node, index, seq))
+			mac = Mac{qemuOUI[0], qemuOUI[1], qemuOUI[2], h[0], h[1], h[2]}
+			if _, used := nm.macs[mac]; !used {
+				break
+			}
+		}
+	} else if first, used := nm.macs[mac]; used {
+		return Mac{}, fmt.Errorf("MAC address %s already used at %s", mac, first)
+	}
+
+	nm.macs[mac] = pos
+	return mac, nil
+}
+
+func invalidNameChar(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	case r == '.', r == '-', r == '_':
+		return false
+	}
+	return true
+}
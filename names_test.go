@@ -0,0 +1,61 @@
+package labomatic
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestNames(t *testing.T) {
+	const script = `
+lan = Subnet(network="192.0.2.0/24")
+r1 = Router()
+sw = CyberSwitch(image="/dev/null")
+r2 = Router("r2")
+r3 = Router()
+plc = Asset("plc-line3-cell2")
+`
+	for range 2 {
+		th := &starlark.Thread{}
+		globals, err := starlark.ExecFile(th, "conf.star", script, NetBlocks)
+		if err != nil {
+			t.Fatalf("cannot load script: %s", err)
+		}
+
+		want := map[string]string{"lan": "br1", "r1": "r1", "sw": "sw1", "r2": "r2", "r3": "r3", "plc": "plc-line3-cell2"}
+		for v, name := range want {
+			var got string
+			switch n := globals[v].(type) {
+			case *netnode:
+				got = n.name
+			case *subnet:
+				got = n.name
+			}
+			if got != name {
+				t.Errorf("%s: want name %s, got %s", v, name, got)
+			}
+		}
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	const script = `
+r1 = Router()
+lan = Subnet(name="r1", network="192.0.2.0/24")
+`
+	_, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err == nil || !strings.Contains(err.Error(), "name r1 already used at conf.star:2:12") {
+		t.Errorf("want duplicate name error, got %v", err)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	for _, name := range []string{"r 1", "r/1", "plc\\1"} {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", "Router(name="+strconv.Quote(name)+")", NetBlocks)
+		if err == nil || !strings.Contains(err.Error(), "invalid name") {
+			t.Errorf("%s: want invalid name error, got %v", name, err)
+		}
+	}
+}
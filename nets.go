@@ -11,37 +11,57 @@ import (
 	"go.starlark.net/starlark"
 )
 
-var netCount = 1
-
 func NewSubnet(th *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
 		name     string
 		network  string
+		network6 string
 		host     bool
 		linkonly bool
+		vlans    bool
+		auto     bool
+		dhcp     bool
+		rg       starlark.Tuple
+		options  *starlark.Dict
 
 		dns dnsConfig
 	)
 	if err := starlark.UnpackArgs("Subnet", args, kwargs,
 		"network?", &network,
+		"network6?", &network6,
 		"link_only?", &linkonly,
 		"name?", &name,
 		"host?", &host,
-		"dns_server?", &dns.Server, "dns_domain?", &dns.Domain); err != nil {
+		"vlan_filtering?", &vlans,
+		"auto_addr?", &auto,
+		"dns_server?", &dns.Server, "dns_domain?", &dns.Domain,
+		"dhcp?", &dhcp, "range?", &rg, "options?", &options); err != nil {
 		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
 	}
-	if network == "" && !linkonly {
+	if network == "" && network6 == "" && !linkonly {
 		return starlark.None, fmt.Errorf("no network address provided")
 	}
+	if auto && linkonly {
+		return starlark.None, fmt.Errorf("link_only networks cannot be addressed automatically")
+	}
 
-	if name == "" {
-		name = fmt.Sprintf("br%d", netCount)
-		netCount++
+	name, err := allocName(th, name, "br")
+	if err != nil {
+		return starlark.None, err
 	}
 
-	sub, err := netip.ParsePrefix(network)
-	if err != nil && !linkonly {
-		return starlark.None, fmt.Errorf("invalid network specification %s: %w", network, err)
+	var sub, sub6 netip.Prefix
+	if network != "" {
+		sub, err = netip.ParsePrefix(network)
+		if err != nil || !sub.Addr().Is4() {
+			return starlark.None, fmt.Errorf("invalid network specification %s: want an IPv4 prefix", network)
+		}
+	}
+	if network6 != "" {
+		sub6, err = netip.ParsePrefix(network6)
+		if err != nil || !sub6.Addr().Is6() {
+			return starlark.None, fmt.Errorf("invalid network specification %s: want an IPv6 prefix", network6)
+		}
 	}
 
 	switch {
@@ -49,14 +69,31 @@ func NewSubnet(th *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, k
 		return starlark.None, fmt.Errorf("DNS domain can only be set if dns_server is also provided")
 	case dns.Server != "" && !host:
 		return starlark.None, fmt.Errorf("DNS configuration only makes sense in host networks")
+	case !dhcp && (len(rg) > 0 || options != nil):
+		return starlark.None, fmt.Errorf("range and options can only be set if dhcp is enabled")
+	case dhcp && (!host || !sub.IsValid() || linkonly):
+		return starlark.None, fmt.Errorf("DHCP requires a host network with an IPv4 address")
+	}
+
+	var dcfg *dhcpConfig
+	if dhcp {
+		dcfg, err = newDHCPConfig(sub, rg, options)
+		if err != nil {
+			return starlark.None, err
+		}
 	}
 
 	return &subnet{
 		name:     name,
 		network:  sub,
+		network6: sub6,
 		host:     host,
 		dns:      dns,
 		linkonly: linkonly,
+		dhcp:     dcfg,
+
+		vlanfiltering: vlans,
+		autoaddr:      auto,
 	}, nil
 }
 
@@ -81,14 +118,13 @@ func NewNATLAN(th *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, k
 		return starlark.None, fmt.Errorf("invalid constructor: %w", err)
 	}
 
-	if name == "" {
-		name = fmt.Sprintf("dx%d", netCount)
-		netCount++
+	name, err := allocName(th, name, "dx")
+	if err != nil {
+		return starlark.None, err
 	}
 
 	sub := defaultUserNet
 	if network != "" {
-		var err error
 		sub, err = netip.ParsePrefix(network)
 		if err != nil {
 			return starlark.None, fmt.Errorf("invalid network specification %s: %w", network, err)
@@ -115,10 +151,27 @@ type subnet struct {
 	// no addressing performed during set-up
 	linkonly bool
 
+	// the bridge filters VLANs, set on member ports
+	vlanfiltering bool
+
+	// attached interfaces without an address get the next free one
+	autoaddr bool
+
 	dns dnsConfig
 
-	network netip.Prefix
-	mbs     []*netiface
+	// DHCPv4 served from the host, nil if disabled
+	dhcp *dhcpConfig
+
+	network  netip.Prefix
+	network6 netip.Prefix
+	mbs      []*netiface
+
+	// kernel names of the bridge, and of the veth end in the host namespace, set in Build
+	link     string
+	hostlink string
+
+	dhcpd *dhcpServer
+	zone  string // lab DNS zone, served from the host address
 }
 
 func (r *subnet) Freeze()               { r.frozen = true }
@@ -133,11 +186,17 @@ func (r subnet) Len() int                   { return len(r.mbs) }
 func (subnet) AttrNames() []string {
 	return []string{
 		"addr",
+		"addr6",
+		"auto_addr",
+		"dhcp",
 		"dns_domain",
 		"dns_server",
 		"host",
 		"link_only",
 		"network",
+		"network6",
+		"reserve",
+		"vlan_filtering",
 	}
 }
 
@@ -145,6 +204,12 @@ func (r *subnet) Attr(name string) (starlark.Value, error) {
 	switch name {
 	case "addr":
 		return getaddr.BindReceiver(r), nil
+	case "addr6":
+		return getaddr6.BindReceiver(r), nil
+	case "auto_addr":
+		return starlark.Bool(r.autoaddr), nil
+	case "dhcp":
+		return starlark.Bool(r.dhcp != nil), nil
 	case "dns_domain":
 		return starlark.String(r.dns.Domain), nil
 	case "dns_server":
@@ -155,6 +220,12 @@ func (r *subnet) Attr(name string) (starlark.Value, error) {
 		return starlark.Bool(r.linkonly), nil
 	case "network":
 		return Prefix(r.network), nil
+	case "network6":
+		return Prefix(r.network6), nil
+	case "reserve":
+		return reserveAddr.BindReceiver(r), nil
+	case "vlan_filtering":
+		return starlark.Bool(r.vlanfiltering), nil
 	}
 
 	return nil, starlark.NoSuchAttrError(name)
@@ -166,39 +237,157 @@ var getaddr = starlark.NewBuiltin("addr", func(thread *starlark.Thread, fn *star
 	if err := starlark.UnpackArgs("addr", args, kwargs, "num", &num); err != nil {
 		return starlark.None, err
 	}
-	if nn.linkonly {
+	return nn.nthaddr(nn.network, num)
+})
+
+var getaddr6 = starlark.NewBuiltin("addr6", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	nn := fn.Receiver().(*subnet)
+	var num int
+	if err := starlark.UnpackArgs("addr6", args, kwargs, "num", &num); err != nil {
+		return starlark.None, err
+	}
+	return nn.nthaddr(nn.network6, num)
+})
+
+// nthaddr returns the address num in pf, which is either of the subnet networks.
+func (nn *subnet) nthaddr(pf netip.Prefix, num int) (starlark.Value, error) {
+	switch {
+	case nn.linkonly:
 		return starlark.None, fmt.Errorf("network is link_only (does not allow addressing)")
+	case !pf.IsValid():
+		return starlark.None, fmt.Errorf("no network of this family in subnet %s", nn.name)
+	case num < 0:
+		return starlark.None, fmt.Errorf("invalid address number %d", num)
 	}
 
-	if nn.host && num == 1<<(32-nn.network.Bits())-2 {
+	addr, ok := nth(pf, uint64(num))
+	if !ok {
+		return starlark.None, fmt.Errorf("address %d not in subnet %s", num, pf)
+	}
+	if nn.host && addr == last(pf) {
 		return starlark.None, errors.New("last address in host networks is always the host")
 	}
 
-	addr := nn.network.Addr()
-	// yurk
-	for range num {
-		addr = addr.Next()
+	return Addr(addr), nil
+}
+
+// resolve returns the address of a new interface in network pf, from the attach_nic argument v.
+// v is either an address, "auto" for the next free address, or unset (automatic in auto_addr subnets).
+// Addresses already used in the subnet are rejected.
+func (nn *subnet) resolve(v starlark.Value, pf netip.Prefix) (Addr, error) {
+	var addr Addr
+	switch v := v.(type) {
+	case nil:
+		if !nn.autoaddr || !pf.IsValid() {
+			return Addr{}, nil
+		}
+		return nn.nextaddr(pf)
+	case Addr:
+		addr = v
+	case starlark.String:
+		if v == "auto" {
+			if nn.linkonly {
+				return Addr{}, fmt.Errorf("network is link_only (does not allow addressing)")
+			}
+			if !pf.IsValid() {
+				return Addr{}, fmt.Errorf("no network of this family in subnet %s", nn.name)
+			}
+			return nn.nextaddr(pf)
+		}
+		ad, err := netip.ParseAddr(string(v))
+		if err != nil {
+			return Addr{}, fmt.Errorf("invalid address %s: %w", v, err)
+		}
+		addr = Addr(ad)
+	default:
+		return Addr{}, fmt.Errorf("invalid address %s: want Addr, string or \"auto\"", v)
 	}
-	if !nn.network.Contains(addr) {
-		return starlark.None, fmt.Errorf("address %s not in subnet %s", addr, nn.network)
+
+	if addr.IsValid() && nn.inuse(addr.Addr()) {
+		return Addr{}, fmt.Errorf("address %s already used in subnet %s", addr, nn.name)
 	}
+	return addr, nil
+}
 
-	return Addr(addr), nil
-})
+// nextaddr returns the first free address of pf, skipping the host address.
+func (nn *subnet) nextaddr(pf netip.Prefix) (Addr, error) {
+	for n := uint64(1); ; n++ {
+		addr, ok := nth(pf, n)
+		if !ok || (addr.Is4() && addr == last(pf).Next()) { // broadcast
+			return Addr{}, fmt.Errorf("no free address left in subnet %s", nn.name)
+		}
+		if (nn.host && addr == last(pf)) || nn.inuse(addr) {
+			continue
+		}
+		return Addr(addr), nil
+	}
+}
+
+func (nn *subnet) inuse(addr netip.Addr) bool {
+	for _, ifc := range nn.mbs {
+		if ifc.addr.Addr() == addr || ifc.addr6.Addr() == addr {
+			return true
+		}
+	}
+	if nn.dhcp != nil {
+		for _, ad := range nn.dhcp.reserved {
+			if ad == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nth returns the address at offset n from the start of pf.
+// ok is false if the address falls outside of pf.
+func nth(pf netip.Prefix, n uint64) (addr netip.Addr, ok bool) {
+	bits := pf.Addr().AsSlice()
+	for i := len(bits) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(bits[i]) + n&0xff
+		bits[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	if n > 0 {
+		return netip.Addr{}, false
+	}
+
+	addr, _ = netip.AddrFromSlice(bits)
+	return addr, pf.Contains(addr)
+}
 
-// last returns the last assignable address in pf (so network broadcast - 1)
+// last returns the last assignable address in pf (so network broadcast - 1).
+// IPv6 networks have no broadcast, but the same address is used for consistency.
 func last(pf netip.Prefix) netip.Addr {
-	bits := pf.Addr().As4()
-	ui := uint32(bits[0])<<24 | uint32(bits[1])<<16 | uint32(bits[2])<<8 | uint32(bits[3])
-	ui |= ^uint32(0) >> uint32(pf.Bits())
-	ui--
-	return netip.AddrFrom4([...]byte{byte(ui >> 24), byte(ui >> 16), byte(ui >> 8), byte(ui)})
+	bits := pf.Addr().AsSlice()
+	for i := pf.Bits(); i < len(bits)*8; i++ {
+		bits[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bits)
+	return addr.Prev()
+}
+
+// HostNetworks returns the networks of the lab in globals that are addressed in the host namespace.
+// Labs running side by side cannot share them, since the host would route to only one.
+func HostNetworks(globals starlark.StringDict) []netip.Prefix {
+	var pfs []netip.Prefix
+	for net := range netsof(globals) {
+		if !net.host || net.linkonly {
+			continue
+		}
+		for _, pf := range []netip.Prefix{net.network, net.network6} {
+			if pf.IsValid() {
+				pfs = append(pfs, pf)
+			}
+		}
+	}
+	return pfs
 }
 
 // netsof returns an iterator over all networks attached to at least one configured VM
 func netsof(globals starlark.StringDict) iter.Seq[*subnet] {
 	var linkednets []*subnet
-	for n := range nodesof(globals, OfType(nodeRouter), OfType(nodeSwitch)) {
+	for n := range nodesof(globals, OfType(nodeRouter), OfType(nodeSwitch), OfType(nodeAsset), OfType(nodeLinux), OfType(nodeHost)) {
 		for _, ifc := range n.ifcs {
 			if !slices.Contains(linkednets, ifc.net) {
 				linkednets = append(linkednets, ifc.net)
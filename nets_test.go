@@ -2,7 +2,11 @@ package labomatic
 
 import (
 	"net/netip"
+	"slices"
+	"strings"
 	"testing"
+
+	"go.starlark.net/starlark"
 )
 
 func TestLast(t *testing.T) {
@@ -12,6 +16,8 @@ func TestLast(t *testing.T) {
 	}{
 		{"192.168.0.0/24", "192.168.0.254"},
 		{"10.10.0.0/16", "10.10.255.254"},
+		{"fd00:1::/64", "fd00:1::ffff:ffff:ffff:fffe"},
+		{"2001:db8::/120", "2001:db8::fe"},
 	}
 
 	for _, c := range cases {
@@ -28,3 +34,118 @@ func TestLast(t *testing.T) {
 		}
 	}
 }
+
+func TestNth(t *testing.T) {
+	cases := []struct {
+		net string
+		num uint64
+		add string
+	}{
+		{"192.168.0.0/24", 1, "192.168.0.1"},
+		{"10.10.0.0/16", 300, "10.10.1.44"},
+		{"fd00:1::/64", 1, "fd00:1::1"},
+		{"fd00:1::/64", 1 << 32, "fd00:1::1:0:0"},
+		{"192.168.0.0/24", 256, ""},
+	}
+
+	for _, c := range cases {
+		pf := netip.MustParsePrefix(c.net)
+		got, ok := nth(pf, c.num)
+		if c.add == "" {
+			if ok {
+				t.Errorf("nth(%s, %d): want out of network, got %s", pf, c.num, got)
+			}
+			continue
+		}
+		if !ok || got != netip.MustParseAddr(c.add) {
+			t.Errorf("nth(%s, %d): want %s, got %s", pf, c.num, c.add, got)
+		}
+	}
+}
+
+func TestAutoAddr(t *testing.T) {
+	cases := []struct {
+		script string
+		want   []string
+		err    string
+	}{
+		{`
+lan = Subnet(network="192.0.2.0/30", auto_addr=True)
+r1, r2 = Router(), Router()
+r1.attach_nic(lan)
+r2.attach_nic(lan)
+`, []string{"192.0.2.1", "192.0.2.2"}, ""},
+		{`
+lan = Subnet(network="192.0.2.0/29", host=True)
+r1, r2, r3 = Router(), Router(), Router()
+r1.attach_nic(lan, addr=lan.addr(2))
+r2.attach_nic(lan, addr="auto")
+r3.attach_nic(lan, addr="auto")
+r3.attach_nic(lan, addr="auto")
+r3.attach_nic(lan, addr="auto")
+`, []string{"192.0.2.2", "192.0.2.1", "192.0.2.3", "192.0.2.4", "192.0.2.5"}, ""},
+		{`
+lan = Subnet(network="192.0.2.0/30", host=True, auto_addr=True)
+r1, r2 = Router(), Router()
+r1.attach_nic(lan)
+r2.attach_nic(lan)
+`, nil, "no free address left"},
+		{`
+lan = Subnet(network="192.0.2.0/24")
+r1, r2 = Router(), Router()
+r1.attach_nic(lan, addr=lan.addr(1))
+r2.attach_nic(lan, addr="192.0.2.1")
+`, nil, "already used"},
+		{`
+lan = Subnet(network="192.0.2.0/24", network6="2001:db8::/64", auto_addr=True)
+r1 = Router()
+r1.attach_nic(lan, addr6=lan.addr6(1))
+r1.attach_nic(lan)
+`, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"}, ""},
+	}
+
+	for _, c := range cases {
+		globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", c.script, NetBlocks)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("want error %q, got %v", c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("cannot load script: %s", err)
+		}
+
+		var got []string
+		for _, ifc := range globals["lan"].(*subnet).mbs {
+			for _, addr := range []Addr{ifc.addr, ifc.addr6} {
+				if addr.IsValid() {
+					got = append(got, addr.String())
+				}
+			}
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("want addresses %v, got %v", c.want, got)
+		}
+	}
+}
+
+func TestHostNetworks(t *testing.T) {
+	const script = `
+lan = Subnet(network="192.0.2.0/24", network6="2001:db8::/64", host=True)
+isolated = Subnet(network="198.51.100.0/24")
+wire = Subnet(link_only=True, host=True)
+r1 = Router()
+r1.attach_nic(lan)
+r1.attach_nic(isolated)
+r1.attach_nic(wire)
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/64")}
+	if got := HostNetworks(globals); !slices.Equal(got, want) {
+		t.Errorf("want host networks %v, got %v", want, got)
+	}
+}
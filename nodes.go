@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash/maphash"
 	"iter"
+	"math"
 	"net/netip"
 	"path/filepath"
 	"slices"
@@ -12,39 +13,50 @@ import (
 	"strings"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 var NetBlocks = starlark.StringDict{
 	"Router":       starlark.NewBuiltin("Router", NewRouter),
 	"CyberSwitch":  starlark.NewBuiltin("CyberSwitch", NewSwitch),
 	"Asset":        starlark.NewBuiltin("CyberSwitch", NewAsset),
+	"Linux":        starlark.NewBuiltin("Linux", NewLinux),
+	"Host":         starlark.NewBuiltin("Host", NewHost),
 	"Subnet":       starlark.NewBuiltin("Subnet", NewSubnet),
 	"Outnet":       starlark.NewBuiltin("Outnet", NewNATLAN),
 	"dhcp_options": dhcpOptions,
+	"routeros":     routerOS,
 	"Addr":         starlark.NewBuiltin("Addr", NewAddr),
+	"Prefix":       starlark.NewBuiltin("Prefix", NewPrefix),
 }
 
 func NewRouter(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
 		name string
+		res  vmresources
 	)
 	if err := starlark.UnpackArgs("Router", args, kwargs,
 		"name?", &name,
+		"cpus?", &res.cpus,
+		"memory?", &res.memory,
+		"machine?", &res.machine,
 	); err != nil {
 		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
 	}
+	if err := res.validate(); err != nil {
+		return starlark.None, err
+	}
 
-	switch {
-	case len(name) > 8:
-		return starlark.None, fmt.Errorf("node names must be <8 characters")
-	case name == "":
-		name = fmt.Sprintf("r%d", routerCount)
-		routerCount++
+	name, err := allocName(th, name, "r")
+	if err != nil {
+		return starlark.None, err
 	}
 
 	return &netnode{
-		name: name,
-		typ:  nodeRouter,
+		labdir: labdirof(th),
+		name:   name,
+		typ:    nodeRouter,
+		res:    res,
 	}, nil
 }
 
@@ -53,20 +65,24 @@ func NewSwitch(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kw
 		name  string
 		image string
 		media string
+		res   vmresources
 	)
 	if err := starlark.UnpackArgs("CyberSwitch", args, kwargs,
 		"name?", &name,
 		"image?", &image,
-		"media?", &media); err != nil {
+		"media?", &media,
+		"cpus?", &res.cpus,
+		"memory?", &res.memory,
+		"machine?", &res.machine); err != nil {
 		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
 	}
+	if err := res.validate(); err != nil {
+		return starlark.None, err
+	}
 
-	switch {
-	case len(name) > 8:
-		return starlark.None, fmt.Errorf("node names must be <8 characters")
-	case name == "":
-		name = fmt.Sprintf("r%d", routerCount)
-		routerCount++
+	name, err := allocName(th, name, "sw")
+	if err != nil {
+		return starlark.None, err
 	}
 
 	if !filepath.IsAbs(image) {
@@ -75,49 +91,206 @@ func NewSwitch(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kw
 	}
 
 	return &netnode{
-		name:  name,
-		typ:   nodeSwitch,
-		uefi:  true,
-		image: image,
-		media: media,
+		labdir: labdirof(th),
+		name:   name,
+		typ:    nodeSwitch,
+		uefi:   true,
+		image:  image,
+		media:  media,
+		res:    res,
 	}, nil
 }
 
 func NewAsset(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
 		name string
+		res  vmresources
 	)
-	if err := starlark.UnpackArgs("CyberSwitch", args, kwargs,
-		"name?", &name); err != nil {
+	if err := starlark.UnpackArgs("Asset", args, kwargs,
+		"name?", &name,
+		"cpus?", &res.cpus,
+		"memory?", &res.memory,
+		"machine?", &res.machine); err != nil {
 		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
 	}
+	if err := res.validate(); err != nil {
+		return starlark.None, err
+	}
 
-	if len(name) > 8 {
-		return starlark.None, fmt.Errorf("node names must be <8 characters")
+	name, err := allocName(th, name, "a")
+	if err != nil {
+		return starlark.None, err
 	}
 
-	if name == "" {
-		name = fmt.Sprintf("a%d", assetCount)
-		assetCount++
+	return &netnode{
+		labdir: labdirof(th),
+		name:   name,
+		typ:    nodeAsset,
+		uefi:   true,
+		res:    res,
+	}, nil
+}
+
+// NewLinux creates a generic Linux VM from a cloud image.
+// The node is configured at boot by cloud-init, using a NoCloud seed generated from the lab definition.
+func NewLinux(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name     string
+		image    string
+		userdata string
+		sshkeys  *starlark.List
+		res      vmresources
+	)
+	if err := starlark.UnpackArgs("Linux", args, kwargs,
+		"name?", &name,
+		"image", &image,
+		"user_data?", &userdata,
+		"ssh_keys?", &sshkeys,
+		"cpus?", &res.cpus,
+		"memory?", &res.memory,
+		"machine?", &res.machine); err != nil {
+		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
+	}
+	if err := res.validate(); err != nil {
+		return starlark.None, err
+	}
+	name, err := allocName(th, name, "l")
+	if err != nil {
+		return starlark.None, err
+	}
+
+	var keys []string
+	if sshkeys != nil {
+		for k := range sshkeys.Elements() {
+			sk, ok := k.(starlark.String)
+			if !ok {
+				return starlark.None, fmt.Errorf("invalid SSH key %s: want a string", k)
+			}
+			keys = append(keys, sk.GoString())
+		}
+	}
+
+	if !filepath.IsAbs(image) {
+		wd := th.Local("workdir").(string)
+		image = filepath.Join(wd, image)
+	}
+
+	return &netnode{
+		labdir:   labdirof(th),
+		name:     name,
+		typ:      nodeLinux,
+		image:    image,
+		userdata: userdata,
+		sshkeys:  keys,
+		res:      res,
+	}, nil
+}
+
+// NewHost creates a light node, running in its own network namespace on the lab host.
+// The init script is run as a shell script in the namespace, once interfaces are configured.
+func NewHost(th *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name string
+		init string
+	)
+	if err := starlark.UnpackArgs("Host", args, kwargs,
+		"name?", &name,
+		"init_script?", &init); err != nil {
+		return starlark.None, fmt.Errorf("invalid constructor argument: %w", err)
+	}
+	name, err := allocName(th, name, "h")
+	if err != nil {
+		return starlark.None, err
 	}
 
 	return &netnode{
-		name: name,
-		typ:  nodeAsset,
-		uefi: true,
+		labdir: labdirof(th),
+		name:   name,
+		typ:    nodeHost,
+		init:   init,
 	}, nil
 }
 
+// vmresources are the virtual hardware given to a node.
+// Zero values are replaced by defaults in validate.
+type vmresources struct {
+	cpus    int
+	memory  memsize
+	machine string
+}
+
+const (
+	defaultCPUs    = 1
+	defaultMemory  = 512 // MiB
+	defaultMachine = "q35"
+)
+
+func (r *vmresources) validate() error {
+	switch {
+	case r.cpus < 0:
+		return fmt.Errorf("invalid number of cpus %d", r.cpus)
+	case r.cpus == 0:
+		r.cpus = defaultCPUs
+	}
+	switch {
+	case r.memory < 0:
+		return fmt.Errorf("invalid memory size %d", r.memory)
+	case r.memory == 0:
+		r.memory = defaultMemory
+	}
+	switch {
+	case strings.ContainsAny(r.machine, ", "):
+		return fmt.Errorf("invalid machine type %q", r.machine)
+	case r.machine == "":
+		r.machine = defaultMachine
+	}
+	return nil
+}
+
+// memsize is a memory size in MiB.
+// From Starlark, it is either an integer (in MiB), or a string with an M or G suffix, as QEMU -m option.
+type memsize int
+
+func (m *memsize) Unpack(v starlark.Value) error {
+	switch v := v.(type) {
+	case starlark.Int:
+		sz, ok := v.Int64()
+		if !ok || sz > math.MaxInt32 {
+			return fmt.Errorf("memory size %s out of range", v)
+		}
+		*m = memsize(sz)
+		return nil
+	case starlark.String:
+		sz, err := parseMemsize(string(v))
+		*m = sz
+		return err
+	default:
+		return fmt.Errorf("got %s, want int or string", v.Type())
+	}
+}
+
+func parseMemsize(s string) (memsize, error) {
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		unit = 1024
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		s = s[:len(s)-1]
+	}
+	sz, err := strconv.Atoi(s)
+	if err != nil || sz > math.MaxInt32/unit {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return memsize(sz * unit), nil
+}
+
 const (
 	nodeRouter = iota
 	nodeSwitch
 	nodeAsset
-)
-
-// TODO check name conflict with user inputs or other modules (starlark threads)
-var (
-	routerCount = 1
-	assetCount  = 1
+	nodeLinux
+	nodeHost
 )
 
 type netnode struct {
@@ -128,8 +301,19 @@ type netnode struct {
 	image string // image on disk
 	uefi  bool
 	media string // additional disk
+	res   vmresources
 
-	init string
+	init     string
+	initfile string // relative to labdir
+	labdir   string
+	vars     map[string]any // template data, see [TemplateNode]
+	varsv    *starlark.Dict // vars as set in the definition, frozen
+	ros      []rosCommand   // built with the routeros module
+	deps     []*netnode     // booted before the node
+
+	// cloud-init seed (Linux nodes)
+	userdata string
+	sshkeys  []string
 
 	ifcs []*netiface
 }
@@ -148,6 +332,10 @@ func (r netnode) String() string {
 		return "<switch>" + r.name
 	case nodeAsset:
 		return "<asset>" + r.name
+	case nodeLinux:
+		return "<linux>" + r.name
+	case nodeHost:
+		return "<host>" + r.name
 	}
 }
 func (netnode) Truth() starlark.Bool { return true }
@@ -159,6 +347,27 @@ func (r *netnode) Attr(name string) (starlark.Value, error) {
 		return attach_iface.BindReceiver(r), nil
 	case "name":
 		return starlark.String(r.name), nil
+	case "cpus":
+		return starlark.MakeInt(r.res.cpus), nil
+	case "memory":
+		return starlark.MakeInt(int(r.res.memory)), nil
+	case "machine":
+		return starlark.String(r.res.machine), nil
+	case "init_script":
+		return starlark.String(r.init), nil
+	case "init_file":
+		return starlark.String(r.initfile), nil
+	case "vars":
+		if r.varsv == nil {
+			return starlark.None, nil
+		}
+		return r.varsv, nil
+	case "depends_on":
+		deps := make([]starlark.Value, len(r.deps))
+		for i, d := range r.deps {
+			deps[i] = d
+		}
+		return starlark.NewList(deps), nil
 	}
 
 	if idx := slices.IndexFunc(r.ifcs, func(iface *netiface) bool { return iface.name == name }); idx != -1 {
@@ -174,9 +383,15 @@ func (r netnode) AttrNames() (attrs []string) {
 	}
 
 	return append(attrs,
+		"cpus",
+		"machine",
+		"memory",
 		"name",
 		"init_script",
-		"attach_iface",
+		"init_file",
+		"vars",
+		"depends_on",
+		"attach_nic",
 	)
 }
 
@@ -187,36 +402,87 @@ var attach_iface = starlark.NewBuiltin("attach_nic", func(thread *starlark.Threa
 	}
 
 	var (
-		net  *subnet
-		addr Addr
+		net           *subnet
+		addrv, addr6v starlark.Value
+		mac           string
+
+		vlan   int
+		trunk  *starlark.List
+		native int
+
+		delay, jitter, rate string
+		loss                starlark.Value
 	)
 
 	if err := starlark.UnpackArgs("attach_nic", args, kwargs,
 		"net", &net,
-		"addr?", &addr,
+		"addr?", &addrv,
+		"addr6?", &addr6v,
+		"mac?", &mac,
+		"vlan?", &vlan,
+		"trunk?", &trunk,
+		"native?", &native,
+		"delay?", &delay,
+		"jitter?", &jitter,
+		"loss?", &loss,
+		"rate?", &rate,
 	); err != nil {
 		return starlark.None, err
 	}
+	vlans, err := newVlanport(net, vlan, trunk, native)
+	if err != nil {
+		return starlark.None, err
+	}
+	impair, err := unpackImpairment(delay, jitter, loss, rate)
+	if err != nil {
+		return starlark.None, err
+	}
 
 	if len(nd.ifcs) == 9 {
 		return starlark.None, errors.New("only 9 interfaces can be added")
 	}
+	addr, err := net.resolve(addrv, net.network)
+	if err != nil {
+		return starlark.None, err
+	}
+	addr6, err := net.resolve(addr6v, net.network6)
+	if err != nil {
+		return starlark.None, err
+	}
 	if net.nat && !netip.Addr(addr).IsValid() {
 		return starlark.None, errors.New("Outnet links must be statically addressed")
 	}
+	var hwaddr Mac
+	if mac != "" {
+		if hwaddr, err = ParseMac(mac); err != nil {
+			return starlark.None, err
+		}
+	}
+	hwaddr, err = allocMac(thread, hwaddr, nd.name, len(nd.ifcs))
+	if err != nil {
+		return starlark.None, err
+	}
+	if addr.IsValid() && !addr.Addr().Is4() {
+		return starlark.None, fmt.Errorf("address %s is not an IPv4 address (use addr6)", addr)
+	}
+	if addr6.IsValid() && !addr6.Addr().Is6() {
+		return starlark.None, fmt.Errorf("address %s is not an IPv6 address", addr6)
+	}
 
-	// TODO use MAC address instead
+	// names identify the interface in the lab definition;
+	// guest names are resolved from the MAC address when the node is provisioned.
 	var ifname string
 	switch nd.typ {
-	case nodeSwitch, nodeAsset:
-		const pciOffset = 0
+	case nodeSwitch, nodeAsset, nodeLinux, nodeHost:
 		ifname = fmt.Sprintf("eth%d", len(nd.ifcs))
 	case nodeRouter:
-		const pciOffset = 2 // but it might differ between laptops ???
-		ifname = fmt.Sprintf("ether%d", len(nd.ifcs)+pciOffset)
+		ifname = fmt.Sprintf("ether%d", len(nd.ifcs)+2)
 	}
 
-	ifc := &netiface{name: ifname, host: nd, net: net, addr: addr}
+	ifc := &netiface{name: ifname, host: nd, net: net, addr: addr, addr6: addr6, mac: hwaddr, vlans: vlans, impair: impair}
+	if thread.CallStackDepth() > 1 {
+		ifc.pos = thread.CallFrame(1).Pos
+	}
 	nd.ifcs = append(nd.ifcs, ifc)
 	net.mbs = append(net.mbs, ifc)
 	return ifc, nil
@@ -247,6 +513,50 @@ func (r *netnode) SetField(name string, val starlark.Value) error {
 			return errors.New("invalid type for init script (want string)")
 		}
 		r.init = ss.GoString()
+	case "init_file":
+		ss, ok := val.(starlark.String)
+		if !ok {
+			return errors.New("invalid type for init file (want string)")
+		}
+		if !filepath.IsLocal(ss.GoString()) {
+			return fmt.Errorf("init file %s is not in the lab directory", ss)
+		}
+		r.initfile = ss.GoString()
+	case "vars":
+		dict, ok := val.(*starlark.Dict)
+		if !ok {
+			return errors.New("invalid type for vars (want dict)")
+		}
+		vars, err := templateValue(dict)
+		if err != nil {
+			return fmt.Errorf("invalid vars: %w", err)
+		}
+		r.vars = vars.(map[string]any)
+		// a copy, so that later changes to dict are not silently ignored
+		r.varsv = starlark.NewDict(dict.Len())
+		for _, it := range dict.Items() {
+			r.varsv.SetKey(it[0], it[1])
+		}
+		r.varsv.Freeze()
+	case "depends_on":
+		l, ok := val.(*starlark.List)
+		if !ok {
+			return errors.New("invalid type for depends_on (want list of nodes)")
+		}
+		var deps []*netnode
+		for v := range l.Elements() {
+			dep, ok := v.(*netnode)
+			if !ok {
+				return fmt.Errorf("invalid dependency %s: want a node", v)
+			}
+			if dep == r {
+				return fmt.Errorf("node %s cannot depend on itself", r.name)
+			}
+			if !slices.Contains(deps, dep) {
+				deps = append(deps, dep)
+			}
+		}
+		r.deps = deps
 	}
 	return nil
 }
@@ -259,6 +569,8 @@ func (r *netnode) agent() GuestAgent {
 		return csw{}
 	case nodeAsset:
 		return csw{}
+	case nodeLinux:
+		return linux{}
 	default:
 		panic("unknown node type")
 	}
@@ -270,6 +582,13 @@ type netiface struct {
 	host   *netnode
 	net    *subnet
 	addr   Addr
+	addr6  Addr
+	mac    Mac
+	vlans  vlanport
+	impair impairment
+	pos    syntax.Position // call to attach_nic, for diagnostics
+
+	link string // kernel name of the tap, set in Build
 }
 
 func (r *netiface) Freeze()              { r.frozen = true }
@@ -279,10 +598,16 @@ func (netiface) Truth() starlark.Bool    { return true }
 func (netiface) Type() string            { return "netiface" }
 
 func (r netiface) AttrNames() []string {
-	attrs := []string{"host", "name", "net"}
+	attrs := []string{"host", "mac", "name", "net"}
 	if netip.Addr(r.addr).IsValid() {
 		attrs = append(attrs, "addr")
 	}
+	if netip.Addr(r.addr6).IsValid() {
+		attrs = append(attrs, "addr6")
+	}
+	if r.vlans.configured() {
+		attrs = append(attrs, "native", "trunk", "vlan")
+	}
 	return attrs
 }
 func (r netiface) Attr(name string) (starlark.Value, error) {
@@ -291,15 +616,31 @@ func (r netiface) Attr(name string) (starlark.Value, error) {
 		return starlark.None, starlark.NoSuchAttrError(name)
 	case "addr":
 		return r.addr, nil
+	case "addr6":
+		return r.addr6, nil
 	case "host":
 		return r.host, nil
+	case "mac":
+		return r.mac, nil
 	case "name":
 		return starlark.String(r.name), nil
 	case "net":
 		return r.net, nil
+	case "vlan":
+		return starlark.MakeInt(r.vlans.access), nil
+	case "trunk":
+		return r.vlans.trunkList(), nil
+	case "native":
+		return starlark.MakeInt(r.vlans.native), nil
 	}
 }
 
+// labdirof returns the directory of the lab loaded in th, where init files are read.
+func labdirof(th *starlark.Thread) string {
+	dir, _ := th.Local("labdir").(string)
+	return dir
+}
+
 func OfType(t int) func(n *netnode) bool { return func(n *netnode) bool { return n.typ == t } }
 
 // nodeof returns an iterator over the exported nodes in the configuration script.
@@ -356,17 +697,33 @@ type TemplateNode struct {
 	Image string
 
 	// List of network interfaces
-	Interfaces []struct {
-		Name     string
-		Address  netip.Addr
-		Network  netip.Prefix
-		LinkOnly bool
-		NATed    bool
-	}
+	Interfaces []TemplateInterface
 
 	Host struct {
 		PubKey string
 	}
+
+	// Vars is the vars dictionary of the node
+	Vars map[string]any
+}
+
+// TemplateInterface is a network interface of a [TemplateNode].
+// Address and Address6 are only valid if the interface is statically addressed in this family.
+type TemplateInterface struct {
+	Name     string
+	Address  netip.Addr
+	Network  netip.Prefix
+	Address6 netip.Addr
+	Network6 netip.Prefix
+	MAC      string
+	LinkOnly bool
+	NATed    bool
+
+	// VLAN is the untagged VLAN of access ports.
+	// Trunk ports carry the tagged Trunk VLANs, and the untagged Native VLAN if not 0.
+	VLAN   int
+	Trunk  []int
+	Native int
 }
 
 func (n *netnode) ToTemplate() TemplateNode {
@@ -378,20 +735,21 @@ func (n *netnode) ToTemplate() TemplateNode {
 	t := TemplateNode{
 		Name: n.name,
 		Host: struct{ PubKey string }{string(pub)},
+		Vars: n.vars,
 	}
 	for _, iface := range n.ifcs {
-		t.Interfaces = append(t.Interfaces, struct {
-			Name     string
-			Address  netip.Addr
-			Network  netip.Prefix
-			LinkOnly bool
-			NATed    bool
-		}{
+		t.Interfaces = append(t.Interfaces, TemplateInterface{
 			Name:     iface.name,
 			Address:  netip.Addr(iface.addr),
 			Network:  iface.net.network,
+			Address6: netip.Addr(iface.addr6),
+			Network6: iface.net.network6,
+			MAC:      iface.mac.String(),
 			LinkOnly: iface.net.linkonly,
 			NATed:    iface.net.nat,
+			VLAN:     iface.vlans.access,
+			Trunk:    iface.vlans.trunk,
+			Native:   iface.vlans.native,
 		})
 	}
 	return t
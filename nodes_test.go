@@ -0,0 +1,183 @@
+package labomatic
+
+import (
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestParseMemsize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want memsize
+	}{
+		{"512", 512},
+		{"512M", 512},
+		{"2G", 2048},
+		{"1g", 1024},
+	}
+
+	for _, c := range cases {
+		got, err := parseMemsize(c.in)
+		if err != nil {
+			t.Errorf("parseMemsize(%s): %s", c.in, err)
+		}
+		if got != c.want {
+			t.Errorf("parseMemsize(%s): want %d, got %d", c.in, c.want, got)
+		}
+	}
+
+	for _, in := range []string{"", "2T", "G", "-"} {
+		if _, err := parseMemsize(in); err == nil {
+			t.Errorf("parseMemsize(%s): want error", in)
+		}
+	}
+}
+
+func TestAttachVlans(t *testing.T) {
+	cases := []struct {
+		attach string
+		err    string
+	}{
+		{`r.attach_nic(vlans, vlan=10)`, ""},
+		{`r.attach_nic(vlans, trunk=[10, 20], native=1)`, ""},
+		{`r.attach_nic(vlans)`, ""},
+		{`r.attach_nic(plain, vlan=10)`, "vlan_filtering"},
+		{`r.attach_nic(vlans, vlan=10, trunk=[20])`, "either an access port"},
+		{`r.attach_nic(vlans, native=1)`, "only makes sense for trunks"},
+		{`r.attach_nic(vlans, trunk=[4095])`, "invalid VLAN id"},
+	}
+
+	for _, c := range cases {
+		script := `
+vlans = Subnet(link_only=True, vlan_filtering=True)
+plain = Subnet(link_only=True)
+r = Router()
+` + c.attach
+		_, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", c.attach, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: want error %q, got %v", c.attach, c.err, err)
+		}
+	}
+}
+
+func TestAttachMac(t *testing.T) {
+	const script = `
+lan = Subnet(link_only=True)
+r1 = Router()
+e1 = r1.attach_nic(lan, mac="52:54:00:12:34:56")
+e2 = r1.attach_nic(lan)
+`
+	var macs []string
+	for range 2 {
+		th := &starlark.Thread{}
+		th.SetLocal("labdir", "/home/lab/site1")
+		globals, err := starlark.ExecFile(th, "conf.star", script, NetBlocks)
+		if err != nil {
+			t.Fatalf("cannot load script: %s", err)
+		}
+		if mac := globals["e1"].(*netiface).mac.String(); mac != "52:54:00:12:34:56" {
+			t.Errorf("explicit MAC: got %s", mac)
+		}
+		macs = append(macs, globals["e2"].(*netiface).mac.String())
+	}
+	if macs[0] != macs[1] || !strings.HasPrefix(macs[0], "52:54:00:") {
+		t.Errorf("derived MAC should be stable in QEMU range, got %v", macs)
+	}
+
+	for _, attach := range []string{
+		`r1.attach_nic(lan, mac="52:54:00:12:34:56")`,
+		`r1.attach_nic(lan, mac="01:00:5e:00:00:01")`,
+		`r1.attach_nic(lan, mac="52:54:00")`,
+	} {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script+attach, NetBlocks)
+		if err == nil {
+			t.Errorf("%s: want error", attach)
+		}
+	}
+}
+
+func TestGuestIfnames(t *testing.T) {
+	const script = `
+lan = Subnet(link_only=True)
+r1 = Router()
+r1.attach_nic(lan, mac="52:54:00:00:00:01")
+r1.attach_nic(lan, mac="52:54:00:00:00:02")
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	r1 := globals["r1"].(*netnode)
+
+	dt := r1.ToTemplate()
+	guest := map[string]string{
+		"00:00:00:00:00:00": "lo",
+		"52:54:00:00:00:02": "ether1",
+	}
+	if missing := guestIfnames(&dt, r1.ifcs, guest); missing != r1.ifcs[0] {
+		t.Errorf("want first interface missing, got %v", missing)
+	}
+
+	guest["52:54:00:00:00:01"] = "ether7"
+	if missing := guestIfnames(&dt, r1.ifcs, guest); missing != nil {
+		t.Fatalf("unexpected missing interface %s", missing.name)
+	}
+	if dt.Interfaces[0].Name != "ether7" || dt.Interfaces[1].Name != "ether1" {
+		t.Errorf("guest names not resolved: %+v", dt.Interfaces)
+	}
+	if r1.ifcs[0].name != "ether2" {
+		t.Errorf("lab name should be kept, got %s", r1.ifcs[0].name)
+	}
+}
+
+func TestInitAttrs(t *testing.T) {
+	const script = `
+r1 = Router()
+r1.init_file = "r1.rsc"
+r1.vars = {"asn": 65001}
+ok = r1.init_file == "r1.rsc" and r1.init_script == "" and r1.vars == {"asn": 65001}
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	if globals["ok"] != starlark.True {
+		t.Error("init attributes do not read back as set")
+	}
+
+	_, err = starlark.ExecFile(&starlark.Thread{}, "conf.star", `r1 = Router()
+r1.vars = {"asn": 65001}
+r1.vars["asn"] = 65002
+`, NetBlocks)
+	if err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("want error on changing vars in place, got %v", err)
+	}
+}
+
+func TestNodeAttrNames(t *testing.T) {
+	const script = `
+lan = Subnet(link_only=True)
+r1, r2 = Router(), Router()
+r1.attach_nic(lan)
+r1.depends_on = [r2]
+ok = r1.depends_on == [r2]
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	if globals["ok"] != starlark.True {
+		t.Error("depends_on does not read back as set")
+	}
+	r1 := globals["r1"].(*netnode)
+	for _, name := range r1.AttrNames() {
+		if _, err := r1.Attr(name); err != nil {
+			t.Errorf("attribute %s is listed, but cannot be read: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package labomatic
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// labParams are the parameters supplied to a lab (labctl start -D key=value), exposed to the definition as params.
+// Reads are recorded, so parameters the script uses but nobody supplied, and the other way around, can be reported.
+type labParams struct {
+	file   string
+	values map[string]string
+	used   map[string]bool
+	unset  map[string]syntax.Position // read, but not supplied
+}
+
+const labparamsKey = "labomatic.params"
+
+func newParams(file string, values map[string]string) *labParams {
+	return &labParams{
+		file:   file,
+		values: values,
+		used:   make(map[string]bool),
+		unset:  make(map[string]syntax.Position),
+	}
+}
+
+func (p *labParams) Freeze()               {}
+func (p *labParams) Hash() (uint32, error) { return 0, errors.New("unhashable type: params") }
+func (p *labParams) String() string        { return "params" }
+func (p *labParams) Truth() starlark.Bool  { return len(p.values) > 0 }
+func (p *labParams) Type() string          { return "params" }
+
+func (p *labParams) AttrNames() []string { return []string{"get"} }
+func (p *labParams) Attr(name string) (starlark.Value, error) {
+	if name == "get" {
+		return paramsGet.BindReceiver(p), nil
+	}
+	return nil, starlark.NoSuchAttrError(name)
+}
+
+// Get implements params[key] and key in params.
+func (p *labParams) Get(k starlark.Value) (starlark.Value, bool, error) {
+	key, ok := k.(starlark.String)
+	if !ok {
+		return nil, false, fmt.Errorf("invalid parameter %s: want a string", k)
+	}
+	v, ok := p.lookup(string(key), syntax.MakePosition(&p.file, 0, 0))
+	if !ok {
+		return nil, false, nil
+	}
+	return starlark.String(v), true, nil
+}
+
+func (p *labParams) lookup(key string, pos syntax.Position) (string, bool) {
+	v, ok := p.values[key]
+	if ok {
+		p.used[key] = true
+	} else if _, seen := p.unset[key]; !seen {
+		p.unset[key] = pos
+	}
+	return v, ok
+}
+
+// get returns the parameter converted to the type of the default value: int, float, bool or string.
+var paramsGet = starlark.NewBuiltin("get", func(th *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	p := fn.Receiver().(*labParams)
+	var (
+		key string
+		def starlark.Value = starlark.None
+	)
+	if err := starlark.UnpackPositionalArgs("get", args, kwargs, 1, &key, &def); err != nil {
+		return starlark.None, err
+	}
+
+	pos := syntax.MakePosition(&p.file, 0, 0)
+	if th.CallStackDepth() > 1 {
+		pos = th.CallFrame(1).Pos
+	}
+	v, ok := p.lookup(key, pos)
+	if !ok {
+		return def, nil
+	}
+
+	switch def.(type) {
+	case starlark.Int:
+		i, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return starlark.None, fmt.Errorf("invalid value for parameter %s: want int, got %q", key, v)
+		}
+		return starlark.MakeInt64(i), nil
+	case starlark.Float:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return starlark.None, fmt.Errorf("invalid value for parameter %s: want float, got %q", key, v)
+		}
+		return starlark.Float(f), nil
+	case starlark.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return starlark.None, fmt.Errorf("invalid value for parameter %s: want bool, got %q", key, v)
+		}
+		return starlark.Bool(b), nil
+	}
+	return starlark.String(v), nil
+})
+
+// diagnostics reports parameters read but not supplied, and supplied but never read.
+func (p *labParams) diagnostics() []Diagnostic {
+	var diags []Diagnostic
+	for _, key := range slices.Sorted(maps.Keys(p.unset)) {
+		diags = append(diags, Diagnostic{Pos: p.unset[key], Warning: true, Msg: fmt.Sprintf("parameter %s is not set", key)})
+	}
+	for _, key := range slices.Sorted(maps.Keys(p.values)) {
+		if !p.used[key] {
+			diags = append(diags, Diagnostic{Pos: syntax.MakePosition(&p.file, 0, 0), Warning: true, Msg: fmt.Sprintf("parameter %s is set, but never used", key)})
+		}
+	}
+	return diags
+}
@@ -0,0 +1,52 @@
+package labomatic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	const script = `
+lan = Subnet(network="10.0.0.0/24")
+sw = CyberSwitch(image=params.get("image", "csw.img"))
+sw.attach_nic(lan)
+boot_order = [sw]
+for i in range(params.get("routers", 2)):
+    boot_order.append(Router(name="r%d" % i))
+    boot_order[-1].attach_nic(lan)
+if params.get("debug", False):
+    sw.init_script = "set -x"
+if "site" in params:
+    sw.vars = {"site": params["site"]}
+`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "conf.star"), []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	globals, diags := Check(dir, dir, map[string]string{"routers": "4", "debug": "true", "memory": "2G"})
+	var got []string
+	for _, d := range diags {
+		got = append(got, strings.ReplaceAll(d.String(), dir+"/", ""))
+	}
+	want := []string{
+		"conf.star: warning: parameter site is not set",
+		"conf.star: warning: parameter memory is set, but never used",
+		"conf.star:3:34: warning: parameter image is not set",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want diagnostics\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	lan, sw := globals["lan"].(*subnet), globals["sw"].(*netnode)
+	if len(lan.mbs) != 5 || sw.init != "set -x" || sw.image != filepath.Join(dir, "csw.img") {
+		t.Errorf("parameters not applied: %d interfaces, init %q, image %s", len(lan.mbs), sw.init, sw.image)
+	}
+
+	if _, diags := Check(dir, dir, map[string]string{"routers": "four"}); !HasErrors(diags) ||
+		!strings.Contains(diags[0].Msg, `invalid value for parameter routers: want int, got "four"`) {
+		t.Errorf("want error on invalid int, got %v", diags)
+	}
+}
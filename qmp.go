@@ -1,23 +1,91 @@
 package labomatic
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/vishvananda/netns"
 )
 
+// QMP is a client of the QEMU Machine Protocol, spoken by both the QEMU monitor and the guest agent.
+// Commands are sent one at a time; asynchronous events received meanwhile are sent to [QMP.Events].
 type QMP struct {
-	enc *json.Encoder
-	dec *json.Decoder
+	conn net.Conn
+	enc  *json.Encoder
 
-	net.Conn
+	// Greeting is the banner of the QEMU monitor (see [OpenMonitor]), the guest agent does not send one.
+	Greeting Greeting
+
+	cmdmx sync.Mutex // one command in flight
+	seq   int
+
+	mx      sync.Mutex
+	current string // id of the command in flight
+	reply   chan qmpResponse
+
+	greeting chan Greeting
+	events   chan Event
+	done     chan struct{}
+	err      error // why the connection stopped, set before done is closed
+}
+
+// Greeting is the first message of the QEMU monitor.
+type Greeting struct {
+	Version struct {
+		QEMU struct {
+			Major, Minor, Micro int
+		} `json:"qemu"`
+		Package string `json:"package"`
+	} `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Event is an asynchronous message of the QEMU monitor, e.g. SHUTDOWN, RESET or STOP.
+type Event struct {
+	Name string
+	Data json.RawMessage
+	Time time.Time
+}
+
+// QMPError is an error returned by the server for a command.
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string { return e.Class + ": " + e.Desc }
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *QMPError       `json:"error"`
+}
+
+// maxEvents is the number of events kept until read, later events are dropped.
+const maxEvents = 64
+
+// newQMP starts the client on conn.
+func newQMP(conn net.Conn) *QMP {
+	q := &QMP{
+		conn:     conn,
+		enc:      json.NewEncoder(conn),
+		reply:    make(chan qmpResponse, 1),
+		greeting: make(chan Greeting, 1),
+		events:   make(chan Event, maxEvents),
+		done:     make(chan struct{}),
+	}
+	go q.read()
+	return q
 }
 
-// Open a QMP socket in network namespace ns, using transport ntw and address addr
+// Open a QMP socket to a guest agent in network namespace ns, using transport ntw and address addr
 func OpenQMP(ns, ntw, addr string) (*QMP, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -26,52 +94,162 @@ func OpenQMP(ns, ntw, addr string) (*QMP, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot get namespace handle: %w", err)
 	}
-
-	if err := netns.Set(nh); err != nil {
+	defer nh.Close()
+	revert, err := switchns(nh)
+	if err != nil {
 		return nil, fmt.Errorf("cannot change network namespace: %w", err)
 	}
+	defer revert()
 
 	sh, err := net.Dial(ntw, addr)
 	if err != nil {
 		return nil, fmt.Errorf("cannot contact QMP server %s: %w", addr, err)
 	}
+	return newQMP(sh), nil
+}
 
-	qmp := &QMP{
-		enc:  json.NewEncoder(sh),
-		dec:  json.NewDecoder(sh),
-		Conn: sh,
+// OpenMonitor connects to the QMP monitor of a VM at unix socket path, and negotiates capabilities.
+func OpenMonitor(ctx context.Context, path string) (*QMP, error) {
+	var d net.Dialer
+	sh, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot contact QMP monitor %s: %w", path, err)
 	}
-	return qmp, nil
+	q := newQMP(sh)
+	if err := q.negotiate(ctx); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// negotiate waits for the greeting, and leaves the negotiation mode.
+func (q *QMP) negotiate(ctx context.Context) error {
+	select {
+	case g := <-q.greeting:
+		q.Greeting = g
+	case <-q.done:
+		return fmt.Errorf("no greeting from QMP monitor: %w", q.err)
+	case <-ctx.Done():
+		return fmt.Errorf("no greeting from QMP monitor: %w", ctx.Err())
+	}
+	if err := q.Do(ctx, "qmp_capabilities", nil, nil); err != nil {
+		return fmt.Errorf("cannot negotiate capabilities: %w", err)
+	}
+	return nil
 }
 
-func (q QMP) Do(cmd string, args, repl any) error {
+// Events returns the events sent by the server, the channel is closed with the connection.
+// Events are dropped when the channel is full, so it only needs to be read by interested callers.
+func (q *QMP) Events() <-chan Event { return q.events }
+
+// Close terminates the connection, and the command in flight.
+func (q *QMP) Close() error { return q.conn.Close() }
+
+// Do runs command cmd with arguments args (if not nil), and decodes the result in repl (if not nil).
+// Errors returned by the server are *[QMPError].
+// If ctx expires first, the result received later is discarded.
+func (q *QMP) Do(ctx context.Context, cmd string, args, repl any) error {
+	q.cmdmx.Lock()
+	defer q.cmdmx.Unlock()
+
+	q.seq++
+	id := strconv.Itoa(q.seq)
+	q.mx.Lock()
+	q.current = id
+	select {
+	case <-q.reply: // received as the previous command expired
+	default:
+	}
+	q.mx.Unlock()
+	defer func() {
+		q.mx.Lock()
+		q.current = ""
+		q.mx.Unlock()
+	}()
+
 	execreq := struct {
 		Execute   string `json:"execute"`
 		Arguments any    `json:"arguments,omitempty"`
-	}{cmd, args}
-
-	// don’t block if we can’t access, better to let the caller retry
-	q.Conn.SetDeadline(time.Now().Add(8 * time.Second))
-	// no putting it without request to sync??
-	// q.Conn.Write([]byte{0xff})
-	q.enc.Encode(execreq)
-
-	var res struct {
-		Return json.RawMessage `json:"return"`
-		Error  json.RawMessage `json:"error"`
+		ID        string `json:"id"`
+	}{cmd, args, id}
+	dl, _ := ctx.Deadline()
+	q.conn.SetWriteDeadline(dl)
+	if err := q.enc.Encode(execreq); err != nil {
+		return fmt.Errorf("cannot send %s: %w", cmd, err)
 	}
-	if err := q.dec.Decode(&res); err != nil {
-		return fmt.Errorf("cannot read response: %w", err)
+
+	var res qmpResponse
+	select {
+	case res = <-q.reply:
+	case <-q.done:
+		return fmt.Errorf("no response to %s: %w", cmd, q.err)
+	case <-ctx.Done():
+		return fmt.Errorf("no response to %s: %w", cmd, ctx.Err())
 	}
-	if len(res.Error) > 0 {
-		var err error
-		json.Unmarshal(res.Error, &err)
-		return err
+	if res.Error != nil {
+		return res.Error
 	}
-
 	if repl == nil {
 		return nil
 	}
-
 	return json.Unmarshal(res.Return, repl)
 }
+
+// read dispatches the messages of the server, until the connection is closed.
+func (q *QMP) read() {
+	dec := json.NewDecoder(q.conn)
+	for {
+		var msg struct {
+			Greeting  *Greeting       `json:"QMP"`
+			Event     string          `json:"event"`
+			Data      json.RawMessage `json:"data"`
+			Timestamp struct {
+				Seconds      int64 `json:"seconds"`
+				Microseconds int64 `json:"microseconds"`
+			} `json:"timestamp"`
+			ID json.RawMessage `json:"id"`
+			qmpResponse
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = errors.New("connection closed")
+			}
+			q.err = err
+			close(q.done)
+			close(q.events)
+			return
+		}
+
+		switch {
+		case msg.Greeting != nil:
+			select {
+			case q.greeting <- *msg.Greeting:
+			default:
+			}
+		case msg.Event != "":
+			ev := Event{Name: msg.Event, Data: msg.Data, Time: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000)}
+			select {
+			case q.events <- ev:
+			default:
+				slog.Debug("QMP event dropped", "event", ev.Name)
+			}
+		case msg.Return != nil || msg.Error != nil:
+			// some guest agents do not send back the id, the response is then to the command in flight
+			var id string
+			if len(msg.ID) > 0 {
+				json.Unmarshal(msg.ID, &id)
+			}
+			q.mx.Lock()
+			if q.current != "" && (id == "" || id == q.current) {
+				select {
+				case q.reply <- msg.qmpResponse:
+				default:
+				}
+			} else {
+				slog.Debug("late QMP response dropped", "id", id)
+			}
+			q.mx.Unlock()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package labomatic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeQMP serves QMP on an in-process connection: handle returns the messages sent back for each command.
+func fakeQMP(t *testing.T, greet bool, handle func(cmd string, id json.RawMessage) []any) *QMP {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		enc, dec := json.NewEncoder(server), json.NewDecoder(server)
+		if greet {
+			enc.Encode(map[string]any{"QMP": map[string]any{
+				"version":      map[string]any{"qemu": map[string]int{"major": 9, "minor": 0, "micro": 2}, "package": "Debian 1:9.0.2"},
+				"capabilities": []string{"oob"},
+			}})
+		}
+		for {
+			var req struct {
+				Execute string          `json:"execute"`
+				ID      json.RawMessage `json:"id"`
+			}
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			for _, msg := range handle(req.Execute, req.ID) {
+				enc.Encode(msg)
+			}
+		}
+	}()
+	return newQMP(client)
+}
+
+func TestQMPMonitor(t *testing.T) {
+	var late json.RawMessage
+	q := fakeQMP(t, true, func(cmd string, id json.RawMessage) []any {
+		switch cmd {
+		case "qmp_capabilities":
+			return []any{map[string]any{"return": map[string]any{}, "id": id}}
+		case "query-status":
+			return []any{
+				map[string]any{"event": "STOP", "timestamp": map[string]int64{"seconds": 1700000000, "microseconds": 5}},
+				map[string]any{"return": map[string]any{"status": "stale"}, "id": "0"},
+				map[string]any{"return": map[string]any{"status": "paused"}, "id": id},
+			}
+		case "cont":
+			late = id
+			return nil // answered with the next command
+		case "system_reset":
+			return []any{
+				map[string]any{"return": map[string]any{}, "id": late},
+				map[string]any{"event": "RESET", "data": map[string]any{"guest": true}},
+				map[string]any{"error": map[string]string{"class": "GenericError", "desc": "reset refused"}, "id": id},
+			}
+		}
+		return []any{map[string]any{"error": map[string]string{"class": "CommandNotFound", "desc": "unknown"}, "id": id}}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.negotiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v := q.Greeting.Version.QEMU; v.Major != 9 || v.Micro != 2 {
+		t.Errorf("want QEMU 9.0.2 in greeting, got %+v", q.Greeting)
+	}
+
+	var status struct{ Status string }
+	if err := q.Do(ctx, "query-status", nil, &status); err != nil || status.Status != "paused" {
+		t.Errorf("query-status: want paused, got %q, %v", status.Status, err)
+	}
+	if ev := <-q.Events(); ev.Name != "STOP" || !ev.Time.Equal(time.Unix(1700000000, 5000)) {
+		t.Errorf("want STOP event, got %+v", ev)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := q.Do(short, "cont", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cont: want deadline exceeded, got %v", err)
+	}
+
+	// the late response to cont is not taken for the response to system_reset
+	var qerr *QMPError
+	if err := q.Do(ctx, "system_reset", nil, nil); !errors.As(err, &qerr) || qerr.Class != "GenericError" || qerr.Desc != "reset refused" {
+		t.Errorf("system_reset: want GenericError, got %v", err)
+	}
+	if ev := <-q.Events(); ev.Name != "RESET" || string(ev.Data) != `{"guest":true}` {
+		t.Errorf("want RESET event, got %+v", ev)
+	}
+
+	q.Close()
+	if err := q.Do(ctx, "query-status", nil, nil); err == nil {
+		t.Error("want error on closed connection")
+	}
+	for range q.Events() {
+		// drained until closed
+	}
+}
+
+func TestQMPAgent(t *testing.T) {
+	// guest agents do not greet, and some do not send back the id
+	q := fakeQMP(t, false, func(cmd string, id json.RawMessage) []any {
+		return []any{map[string]any{"return": map[string]int{"pid": 42}}}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var res struct {
+		PID int `json:"pid"`
+	}
+	if err := q.Do(ctx, "guest-exec", map[string]string{"path": "/bin/true"}, &res); err != nil || res.PID != 42 {
+		t.Errorf("guest-exec: want pid 42, got %d, %v", res.PID, err)
+	}
+}
+
+func TestQMPNoGreeting(t *testing.T) {
+	q := fakeQMP(t, false, func(string, json.RawMessage) []any { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.negotiate(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded without greeting, got %v", err)
+	}
+}
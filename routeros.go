@@ -0,0 +1,560 @@
+package labomatic
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// rosCommand is a RouterOS command built from the routeros module, e.g. /ip/address/add.
+// Commands are validated when built, and rendered after the default configuration of the router.
+type rosCommand struct {
+	path string
+	args []rosArg
+}
+
+// rosArg is a command argument.
+// References to lab interfaces are only resolved when rendering, since guest names can differ from lab names.
+type rosArg struct {
+	key string
+	val string
+	ifc *netiface
+}
+
+// renderROS returns the commands of the node, with interfaces named as in dt.
+func (n *netnode) renderROS(dt TemplateNode) string {
+	var buf strings.Builder
+	for _, cmd := range n.ros {
+		buf.WriteString(cmd.path)
+		for _, a := range cmd.args {
+			val := a.val
+			if a.ifc != nil {
+				val = dt.Interfaces[slices.Index(n.ifcs, a.ifc)].Name
+			}
+			buf.WriteString(" " + a.key + "=" + rosQuote(val))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// rosQuote quotes values RouterOS would otherwise split or expand.
+func rosQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\r\"\\$;=[]{}?#") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+var routerOS = &starlarkstruct.Module{
+	Name: "routeros",
+	Members: starlark.StringDict{
+		"address":         rosAddress,
+		"route":           rosRoute,
+		"dhcp_pool":       rosDHCPPool,
+		"dhcp_server":     rosDHCPServer,
+		"firewall_filter": rosFilter,
+		"nat":             rosNAT,
+		"bridge_port":     rosBridgePort,
+	},
+}
+
+// rosBuilder wraps the builders of the routeros module, which all take the router as first argument.
+// unpack reads the other arguments, and returns the command to add to the router.
+func rosBuilder(name string, unpack func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error)) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if len(args) == 0 {
+			return starlark.None, fmt.Errorf("%s: missing router argument", name)
+		}
+		router, ok := args[0].(*netnode)
+		if !ok || router.typ != nodeRouter {
+			return starlark.None, fmt.Errorf("%s: invalid router %s: want a Router node", name, args[0])
+		}
+		if router.frozen {
+			return starlark.None, errors.New("modified frozen data")
+		}
+		cmds, err := unpack(router, args[1:], kwargs)
+		if err != nil {
+			return starlark.None, fmt.Errorf("%s: %w", name, err)
+		}
+		router.ros = append(router.ros, cmds...)
+		return starlark.None, nil
+	})
+}
+
+// rosIface resolves an interface argument: interfaces of the router (as netiface or by lab name) are tracked,
+// bridges created earlier with bridge_port are taken verbatim.
+// Other names are rejected, since they would only fail when the router applies its configuration.
+func rosIface(router *netnode, key string, v starlark.Value) (rosArg, error) {
+	switch v := v.(type) {
+	case *netiface:
+		if v.host != router {
+			return rosArg{}, fmt.Errorf("interface %s is not on %s", v.name, router.name)
+		}
+		return rosArg{key: key, ifc: v}, nil
+	case starlark.String:
+		if v == "" {
+			return rosArg{}, fmt.Errorf("empty %s", key)
+		}
+		if idx := slices.IndexFunc(router.ifcs, func(ifc *netiface) bool { return ifc.name == string(v) }); idx != -1 {
+			return rosArg{key: key, ifc: router.ifcs[idx]}, nil
+		}
+		if slices.ContainsFunc(router.ros, func(c rosCommand) bool { return c.path == "/interface/bridge/add" && c.args[0].val == string(v) }) {
+			return rosArg{key: key, val: string(v)}, nil
+		}
+		return rosArg{}, fmt.Errorf("interface %s is not on %s (want one of its interfaces, or a bridge created with bridge_port)", string(v), router.name)
+	}
+	return rosArg{}, fmt.Errorf("invalid %s %s: want an interface or a name", key, v)
+}
+
+// rosAddr reads an address argument, as Addr or string.
+func rosAddr(what string, v starlark.Value) (netip.Addr, error) {
+	switch v := v.(type) {
+	case Addr:
+		return v.Addr(), nil
+	case starlark.String:
+		ad, err := netip.ParseAddr(string(v))
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid %s %s: %w", what, v, err)
+		}
+		return ad, nil
+	}
+	return netip.Addr{}, fmt.Errorf("invalid %s %s: want Addr or string", what, v)
+}
+
+var rosAddress = rosBuilder("address", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		iface   starlark.Value
+		address starlark.Value
+		comment string
+	)
+	if err := starlark.UnpackArgs("address", args, kwargs,
+		"interface", &iface,
+		"address", &address,
+		"comment?", &comment); err != nil {
+		return nil, err
+	}
+	ifc, err := rosIface(router, "interface", iface)
+	if err != nil {
+		return nil, err
+	}
+
+	// the prefix length is taken from the subnet of lab interfaces if not given
+	var pf netip.Prefix
+	if s, ok := address.(starlark.String); ok && strings.Contains(string(s), "/") {
+		if pf, err = netip.ParsePrefix(string(s)); err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", s, err)
+		}
+	} else {
+		ad, err := rosAddr("address", address)
+		if err != nil {
+			return nil, err
+		}
+		if ifc.ifc == nil {
+			return nil, fmt.Errorf("address %s has no prefix length", ad)
+		}
+		net := ifc.ifc.net.network
+		if ad.Is6() {
+			net = ifc.ifc.net.network6
+		}
+		if !net.Contains(ad) {
+			return nil, fmt.Errorf("address %s is not in subnet %s of %s", ad, ifc.ifc.net.name, ifc.ifc.name)
+		}
+		pf = netip.PrefixFrom(ad, net.Bits())
+	}
+
+	cmd := rosCommand{path: "/ip/address/add"}
+	if pf.Addr().Is6() {
+		cmd.path = "/ipv6/address/add"
+	}
+	cmd.args = []rosArg{ifc, {key: "address", val: pf.String()}}
+	if comment != "" {
+		cmd.args = append(cmd.args, rosArg{key: "comment", val: comment})
+	}
+	return []rosCommand{cmd}, nil
+})
+
+var rosRoute = rosBuilder("route", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		dst      string
+		gateway  starlark.Value
+		distance int
+		comment  string
+	)
+	if err := starlark.UnpackArgs("route", args, kwargs,
+		"dst", &dst,
+		"gateway", &gateway,
+		"distance?", &distance,
+		"comment?", &comment); err != nil {
+		return nil, err
+	}
+	gw, err := rosAddr("gateway", gateway)
+	if err != nil {
+		return nil, err
+	}
+	var pf netip.Prefix
+	if dst == "default" {
+		pf = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if gw.Is6() {
+			pf = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+	} else if pf, err = netip.ParsePrefix(dst); err != nil {
+		return nil, fmt.Errorf("invalid destination %s: %w", dst, err)
+	}
+	if pf.Addr().Is4() != gw.Is4() {
+		return nil, fmt.Errorf("gateway %s is not in the family of %s", gw, pf)
+	}
+	if distance < 0 || distance > 255 {
+		return nil, fmt.Errorf("invalid distance %d: want 1 to 255", distance)
+	}
+
+	cmd := rosCommand{path: "/ip/route/add"}
+	if pf.Addr().Is6() {
+		cmd.path = "/ipv6/route/add"
+	}
+	cmd.args = []rosArg{{key: "dst-address", val: pf.Masked().String()}, {key: "gateway", val: gw.String()}}
+	if distance != 0 {
+		cmd.args = append(cmd.args, rosArg{key: "distance", val: strconv.Itoa(distance)})
+	}
+	if comment != "" {
+		cmd.args = append(cmd.args, rosArg{key: "comment", val: comment})
+	}
+	return []rosCommand{cmd}, nil
+})
+
+var rosDHCPPool = rosBuilder("dhcp_pool", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		name   string
+		ranges *starlark.List
+	)
+	if err := starlark.UnpackArgs("dhcp_pool", args, kwargs,
+		"name", &name,
+		"ranges", &ranges); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, errors.New("empty pool name")
+	}
+	if slices.ContainsFunc(router.ros, func(c rosCommand) bool { return c.path == "/ip/pool/add" && c.args[0].val == name }) {
+		return nil, fmt.Errorf("pool %s already defined on %s", name, router.name)
+	}
+	rgs, err := stringList("range", ranges)
+	if err != nil {
+		return nil, err
+	}
+	if len(rgs) == 0 {
+		return nil, errors.New("empty range list")
+	}
+	for _, rg := range rgs {
+		if _, err := netip.ParsePrefix(rg); err == nil {
+			continue
+		}
+		from, to, ok := strings.Cut(rg, "-")
+		a, erra := netip.ParseAddr(from)
+		b, errb := netip.ParseAddr(to)
+		if !ok || erra != nil || errb != nil || !a.Is4() || !b.Is4() || b.Less(a) {
+			return nil, fmt.Errorf("invalid range %s: want first-last or a network", rg)
+		}
+	}
+	return []rosCommand{{path: "/ip/pool/add", args: []rosArg{
+		{key: "name", val: name},
+		{key: "ranges", val: strings.Join(rgs, ",")},
+	}}}, nil
+})
+
+var rosDHCPServer = rosBuilder("dhcp_server", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		iface   starlark.Value
+		pool    string
+		network string
+		gateway starlark.Value
+		dns     *starlark.List
+		name    string
+	)
+	if err := starlark.UnpackArgs("dhcp_server", args, kwargs,
+		"interface", &iface,
+		"pool", &pool,
+		"network", &network,
+		"gateway?", &gateway,
+		"dns?", &dns,
+		"name?", &name); err != nil {
+		return nil, err
+	}
+	ifc, err := rosIface(router, "interface", iface)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(router.ros, func(c rosCommand) bool { return c.path == "/ip/pool/add" && c.args[0].val == pool }) {
+		return nil, fmt.Errorf("pool %s is not defined on %s (use dhcp_pool first)", pool, router.name)
+	}
+	pf, err := netip.ParsePrefix(network)
+	if err != nil || !pf.Addr().Is4() {
+		return nil, fmt.Errorf("invalid network %s: want an IPv4 network", network)
+	}
+	if name == "" {
+		n := 0
+		for _, c := range router.ros {
+			if c.path == "/ip/dhcp-server/add" {
+				n++
+			}
+		}
+		name = fmt.Sprintf("dhcp%d", n+1)
+	}
+
+	netargs := []rosArg{{key: "address", val: pf.Masked().String()}}
+	if gateway != nil {
+		gw, err := rosAddr("gateway", gateway)
+		if err != nil {
+			return nil, err
+		}
+		if !pf.Contains(gw) {
+			return nil, fmt.Errorf("gateway %s is not in network %s", gw, pf)
+		}
+		netargs = append(netargs, rosArg{key: "gateway", val: gw.String()})
+	}
+	if dns != nil {
+		var servers []string
+		for v := range dns.Elements() {
+			ad, err := rosAddr("DNS server", v)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, ad.String())
+		}
+		netargs = append(netargs, rosArg{key: "dns-server", val: strings.Join(servers, ",")})
+	}
+
+	return []rosCommand{
+		{path: "/ip/dhcp-server/add", args: []rosArg{{key: "name", val: name}, ifc, {key: "address-pool", val: pool}}},
+		{path: "/ip/dhcp-server/network/add", args: netargs},
+	}, nil
+})
+
+// rosMatch holds the matchers shared by firewall filter and NAT rules.
+// Rules are added under /ip/firewall, so only match IPv4 addresses.
+type rosMatch struct {
+	protocol, srcAddress, dstAddress, srcPort, dstPort string
+	in, out                                            starlark.Value
+	comment                                            string
+}
+
+func (m *rosMatch) params() []any {
+	return []any{
+		"protocol?", &m.protocol,
+		"src_address?", &m.srcAddress,
+		"dst_address?", &m.dstAddress,
+		"src_port?", &m.srcPort,
+		"dst_port?", &m.dstPort,
+		"in_interface?", &m.in,
+		"out_interface?", &m.out,
+		"comment?", &m.comment,
+	}
+}
+
+var rosProtocols = []string{"tcp", "udp", "icmp", "icmpv6", "gre", "ospf", "vrrp", "ipsec-esp", "ipsec-ah", "sctp"}
+
+// args validates the matchers, and returns them as command arguments.
+func (m *rosMatch) args(router *netnode) ([]rosArg, error) {
+	var args []rosArg
+	if m.protocol != "" {
+		if _, err := strconv.ParseUint(m.protocol, 10, 8); err != nil && !slices.Contains(rosProtocols, m.protocol) {
+			return nil, fmt.Errorf("unknown protocol %s (want a protocol number, or one of %s)", m.protocol, strings.Join(rosProtocols, ", "))
+		}
+		args = append(args, rosArg{key: "protocol", val: m.protocol})
+	}
+	for _, a := range []struct{ key, val string }{{"src-address", m.srcAddress}, {"dst-address", m.dstAddress}} {
+		if a.val == "" {
+			continue
+		}
+		if err := checkIPv4(a.key, a.val); err != nil {
+			return nil, err
+		}
+		args = append(args, rosArg{key: a.key, val: a.val})
+	}
+	for _, a := range []struct{ key, val string }{{"src-port", m.srcPort}, {"dst-port", m.dstPort}} {
+		if a.val == "" {
+			continue
+		}
+		if m.protocol != "tcp" && m.protocol != "udp" && m.protocol != "sctp" {
+			return nil, fmt.Errorf("%s is only valid with protocol tcp, udp or sctp", a.key)
+		}
+		if err := checkPorts(a.val); err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %w", a.key, a.val, err)
+		}
+		args = append(args, rosArg{key: a.key, val: a.val})
+	}
+	for _, a := range []struct {
+		key string
+		val starlark.Value
+	}{{"in-interface", m.in}, {"out-interface", m.out}} {
+		if a.val == nil || a.val == starlark.None {
+			continue
+		}
+		ifc, err := rosIface(router, a.key, a.val)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, ifc)
+	}
+	if m.comment != "" {
+		args = append(args, rosArg{key: "comment", val: m.comment})
+	}
+	return args, nil
+}
+
+// checkIPv4 validates an IPv4 address or network argument.
+func checkIPv4(key, val string) error {
+	ad, err := netip.ParseAddr(val)
+	if pf, perr := netip.ParsePrefix(val); perr == nil {
+		ad, err = pf.Addr(), nil
+	}
+	switch {
+	case err != nil:
+		return fmt.Errorf("invalid %s %s: want an address or a network", key, val)
+	case !ad.Is4():
+		return fmt.Errorf("invalid %s %s: only IPv4 rules are supported", key, val)
+	}
+	return nil
+}
+
+// checkPorts validates a RouterOS port list, e.g. 22,80,8000-8080
+func checkPorts(ports string) error {
+	for _, p := range strings.Split(ports, ",") {
+		from, to, isrange := strings.Cut(p, "-")
+		a, erra := strconv.ParseUint(from, 10, 16)
+		if erra != nil || a == 0 {
+			return fmt.Errorf("invalid port %s", from)
+		}
+		if isrange {
+			b, errb := strconv.ParseUint(to, 10, 16)
+			if errb != nil || b < a {
+				return fmt.Errorf("invalid port range %s", p)
+			}
+		}
+	}
+	return nil
+}
+
+var rosFilter = rosBuilder("firewall_filter", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		chain, action string
+		state         *starlark.List
+		m             rosMatch
+	)
+	params := append([]any{"chain", &chain, "action", &action, "connection_state?", &state}, m.params()...)
+	if err := starlark.UnpackArgs("firewall_filter", args, kwargs, params...); err != nil {
+		return nil, err
+	}
+	if !slices.Contains([]string{"input", "forward", "output"}, chain) {
+		return nil, fmt.Errorf("unknown chain %s (want input, forward or output)", chain)
+	}
+	actions := []string{"accept", "drop", "reject", "log", "passthrough", "fasttrack-connection"}
+	if !slices.Contains(actions, action) {
+		return nil, fmt.Errorf("unknown action %s (want one of %s)", action, strings.Join(actions, ", "))
+	}
+
+	cargs := []rosArg{{key: "chain", val: chain}, {key: "action", val: action}}
+	if state != nil {
+		states, err := stringList("connection state", state)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range states {
+			if !slices.Contains([]string{"established", "related", "new", "invalid", "untracked"}, s) {
+				return nil, fmt.Errorf("unknown connection state %s (want established, related, new, invalid or untracked)", s)
+			}
+		}
+		cargs = append(cargs, rosArg{key: "connection-state", val: strings.Join(states, ",")})
+	}
+	margs, err := m.args(router)
+	if err != nil {
+		return nil, err
+	}
+	return []rosCommand{{path: "/ip/firewall/filter/add", args: append(cargs, margs...)}}, nil
+})
+
+var rosNAT = rosBuilder("nat", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		chain, action string
+		toAddresses   string
+		toPorts       string
+		m             rosMatch
+	)
+	params := append([]any{"chain", &chain, "action", &action, "to_addresses?", &toAddresses, "to_ports?", &toPorts}, m.params()...)
+	if err := starlark.UnpackArgs("nat", args, kwargs, params...); err != nil {
+		return nil, err
+	}
+	switch {
+	case chain != "srcnat" && chain != "dstnat":
+		return nil, fmt.Errorf("unknown chain %s (want srcnat or dstnat)", chain)
+	case !slices.Contains([]string{"masquerade", "src-nat", "dst-nat", "netmap", "redirect", "accept"}, action):
+		return nil, fmt.Errorf("unknown action %s (want masquerade, src-nat, dst-nat, netmap, redirect or accept)", action)
+	case (action == "masquerade" || action == "src-nat") && chain != "srcnat":
+		return nil, fmt.Errorf("action %s is only valid in chain srcnat", action)
+	case (action == "dst-nat" || action == "redirect") && chain != "dstnat":
+		return nil, fmt.Errorf("action %s is only valid in chain dstnat", action)
+	case (action == "src-nat" || action == "dst-nat" || action == "netmap") && toAddresses == "" && toPorts == "":
+		return nil, fmt.Errorf("action %s needs to_addresses or to_ports", action)
+	}
+
+	margs, err := m.args(router)
+	if err != nil {
+		return nil, err
+	}
+	cargs := append([]rosArg{{key: "chain", val: chain}, {key: "action", val: action}}, margs...)
+	if toAddresses != "" {
+		if err := checkIPv4("to_addresses", toAddresses); err != nil {
+			return nil, err
+		}
+		cargs = append(cargs, rosArg{key: "to-addresses", val: toAddresses})
+	}
+	if toPorts != "" {
+		if err := checkPorts(toPorts); err != nil {
+			return nil, fmt.Errorf("invalid to_ports %s: %w", toPorts, err)
+		}
+		cargs = append(cargs, rosArg{key: "to-ports", val: toPorts})
+	}
+	return []rosCommand{{path: "/ip/firewall/nat/add", args: cargs}}, nil
+})
+
+var rosBridgePort = rosBuilder("bridge_port", func(router *netnode, args starlark.Tuple, kwargs []starlark.Tuple) ([]rosCommand, error) {
+	var (
+		bridge string
+		iface  starlark.Value
+		pvid   int
+	)
+	if err := starlark.UnpackArgs("bridge_port", args, kwargs,
+		"bridge", &bridge,
+		"interface", &iface,
+		"pvid?", &pvid); err != nil {
+		return nil, err
+	}
+	if bridge == "" || strings.ContainsFunc(bridge, invalidNameChar) {
+		return nil, fmt.Errorf("invalid bridge name %q", bridge)
+	}
+	if pvid < 0 || pvid > 4094 {
+		return nil, fmt.Errorf("invalid pvid %d: want 1 to 4094", pvid)
+	}
+	ifc, err := rosIface(router, "interface", iface)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds []rosCommand
+	// bridges are created on first use
+	if !slices.ContainsFunc(router.ros, func(c rosCommand) bool { return c.path == "/interface/bridge/add" && c.args[0].val == bridge }) {
+		cmds = append(cmds, rosCommand{path: "/interface/bridge/add", args: []rosArg{{key: "name", val: bridge}}})
+	}
+	port := rosCommand{path: "/interface/bridge/port/add", args: []rosArg{{key: "bridge", val: bridge}, ifc}}
+	if pvid != 0 {
+		port.args = append(port.args, rosArg{key: "pvid", val: strconv.Itoa(pvid)})
+	}
+	return append(cmds, port), nil
+})
@@ -0,0 +1,120 @@
+package labomatic
+
+import (
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestRouterOSBuilders(t *testing.T) {
+	const script = `
+lan = Subnet(network="192.168.10.0/24")
+wan = Outnet()
+r1 = Router()
+r1.attach_nic(wan, addr=wan.addr(2))
+r1.attach_nic(lan)
+r1.attach_nic(lan)
+
+routeros.bridge_port(r1, bridge="bridge1", interface=r1.ether4, pvid=10)
+routeros.bridge_port(r1, bridge="bridge1", interface="ether3")
+routeros.address(r1, interface=r1.ether3, address=lan.addr(1))
+routeros.address(r1, interface="bridge1", address="2001:db8::1/64", comment="lab bridge")
+routeros.route(r1, dst="10.0.0.0/8", gateway="192.168.10.254", distance=2)
+routeros.dhcp_pool(r1, name="lan", ranges=["192.168.10.100-192.168.10.200"])
+routeros.dhcp_server(r1, interface=r1.ether3, pool="lan", network="192.168.10.0/24", gateway=lan.addr(1), dns=["192.0.2.53"])
+routeros.firewall_filter(r1, chain="input", action="accept", connection_state=["established", "related"])
+routeros.firewall_filter(r1, chain="input", action="accept", protocol="tcp", dst_port="22,8000-8080", in_interface="ether3")
+routeros.nat(r1, chain="srcnat", action="masquerade", out_interface=r1.ether2)
+`
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	r1 := globals["r1"].(*netnode)
+
+	dt := TemplateNode{Name: "r1"}
+	for i, name := range []string{"ether1", "ether7", "ether3"} {
+		dt.Interfaces = append(dt.Interfaces, TemplateInterface{Name: name, MAC: r1.ifcs[i].mac.String()})
+	}
+	want := `/interface/bridge/add name=bridge1
+/interface/bridge/port/add bridge=bridge1 interface=ether3 pvid=10
+/interface/bridge/port/add bridge=bridge1 interface=ether7
+/ip/address/add interface=ether7 address=192.168.10.1/24
+/ipv6/address/add interface=bridge1 address=2001:db8::1/64 comment="lab bridge"
+/ip/route/add dst-address=10.0.0.0/8 gateway=192.168.10.254 distance=2
+/ip/pool/add name=lan ranges=192.168.10.100-192.168.10.200
+/ip/dhcp-server/add name=dhcp1 interface=ether7 address-pool=lan
+/ip/dhcp-server/network/add address=192.168.10.0/24 gateway=192.168.10.1 dns-server=192.0.2.53
+/ip/firewall/filter/add chain=input action=accept connection-state=established,related
+/ip/firewall/filter/add chain=input action=accept protocol=tcp dst-port=22,8000-8080 in-interface=ether7
+/ip/firewall/nat/add chain=srcnat action=masquerade out-interface=ether1
+`
+	if got := r1.renderROS(dt); got != want {
+		t.Errorf("want commands\n%s\ngot\n%s", want, got)
+	}
+
+	buf, err := renderInit(r1, dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "/system/identity/set name=\"r1\"\n"+want) {
+		t.Errorf("commands not rendered after the default configuration:\n%s", buf.String())
+	}
+}
+
+func TestRouterOSErrors(t *testing.T) {
+	const prelude = `
+lan = Subnet(network="192.168.10.0/24")
+r1 = Router()
+r1.attach_nic(lan)
+a1 = Asset()
+a1.attach_nic(lan)
+`
+	cases := []struct{ script, err string }{
+		{`routeros.address(r1, interfce=r1.ether2, address="10.0.0.1/24")`, "unexpected keyword argument"},
+		{`routeros.address(a1, interface=a1.eth0, address="10.0.0.1/24")`, "want a Router node"},
+		{`routeros.address(r1, interface=a1.eth0, address="10.0.0.1/24")`, "interface eth0 is not on r1"},
+		{`routeros.address(r1, interface=r1.ether2, address="10.0.0.1")`, "not in subnet"},
+		{`routeros.route(r1, dst="default", gateway="2001:db8::1")`, ""},
+		{`routeros.route(r1, dst="10.0.0.0/8", gateway="2001:db8::1")`, "not in the family"},
+		{`routeros.dhcp_server(r1, interface=r1.ether2, pool="lan", network="192.168.10.0/24")`, "pool lan is not defined"},
+		{`routeros.dhcp_pool(r1, name="lan", ranges=["192.168.10.200-192.168.10.100"])`, "invalid range"},
+		{`routeros.firewall_filter(r1, chain="inptu", action="accept")`, "unknown chain inptu"},
+		{`routeros.firewall_filter(r1, chain="input", action="allow")`, "unknown action allow"},
+		{`routeros.firewall_filter(r1, chain="input", action="accept", dst_port="22")`, "only valid with protocol"},
+		{`routeros.firewall_filter(r1, chain="input", action="accept", protocol="tcp", dst_port="70000")`, "invalid port"},
+		{`routeros.nat(r1, chain="dstnat", action="masquerade")`, "only valid in chain srcnat"},
+		{`routeros.nat(r1, chain="dstnat", action="dst-nat", protocol="tcp", dst_port="80")`, "needs to_addresses"},
+		{`routeros.bridge_port(r1, bridge="bridge 1", interface=r1.ether2)`, "invalid bridge name"},
+		{`routeros.address(r1, interface="ehter2", address="10.0.0.1/24")`, "interface ehter2 is not on r1"},
+		{`routeros.bridge_port(r1, bridge="br", interface="vlan10")`, "interface vlan10 is not on r1"},
+		{`routeros.firewall_filter(r1, chain="input", action="accept", src_address="2001:db8::/32")`, "only IPv4 rules"},
+		{`routeros.nat(r1, chain="dstnat", action="dst-nat", to_addresses="2001:db8::1")`, "only IPv4 rules"},
+		{`routeros.nat(r1, chain="dstnat", action="dst-nat", to_addresses="192.168.10.3")`, ""},
+	}
+	for _, c := range cases {
+		_, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", prelude+c.script, NetBlocks)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", c.script, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: want error %q, got %v", c.script, c.err, err)
+		}
+	}
+}
+
+func TestRosQuote(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"ether2", "ether2"},
+		{"lab bridge", `"lab bridge"`},
+		{`say "hi" $name`, `"say \"hi\" \$name"`},
+		{"", `""`},
+		{"line\r\n/system/reboot", `"line\r\n/system/reboot"`},
+	}
+	for _, c := range cases {
+		if got := rosQuote(c.in); got != c.out {
+			t.Errorf("rosQuote(%q): want %s, got %s", c.in, c.out, got)
+		}
+	}
+}
@@ -26,7 +26,8 @@ func UserNumID(u user.User) (uid, gid uint64, err error) {
 	return
 }
 
-func RunAsset(ctx context.Context, name string, runas user.User) (int32, error) {
+// RunAsset opens a shell in the namespace of host node name of lab, and returns the pty.
+func RunAsset(ctx context.Context, lab *Instance, name string, runas user.User) (int32, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
@@ -35,11 +36,15 @@ func RunAsset(ctx context.Context, name string, runas user.User) (int32, error)
 		return -1, fmt.Errorf("finding unix user %s: %w", runas, err)
 	}
 
-	hdl, err := netns.GetFromName(name)
+	hdl, err := netns.GetFromName(lab.hostns(name))
 	if err != nil {
-		return -1, fmt.Errorf("no such namespace %s: %w", name, err)
+		return -1, fmt.Errorf("no such host %s: %w", name, err)
 	}
-	netns.Set(hdl)
+	revert, err := switchns(hdl)
+	if err != nil {
+		return -1, err
+	}
+	defer revert()
 
 	cmd := exec.Command("/bin/bash")
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -0,0 +1,138 @@
+package labomatic
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// RunHost starts the given node of lab in its own network namespace, with a veth for each interface into the lab bridges.
+// It must be called from a goroutine locked to its thread, currently in nslab.
+// If an error is returned, the namespace might still need to be deleted.
+func RunHost(lab *Instance, node *netnode, nslab netns.NsHandle) error {
+	// creating the namespace moves the thread into it
+	nshost, err := netns.NewNamed(lab.hostns(node.name))
+	if err != nil {
+		return fmt.Errorf("cannot create namespace: %w", err)
+	}
+	defer nshost.Close()
+	if err := netns.Set(nslab); err != nil {
+		return fmt.Errorf("cannot return to lab namespace: %w", err)
+	}
+
+	lk, err := netlink.NewHandleAt(nshost)
+	if err != nil {
+		return fmt.Errorf("obtaining netlink handle: %w", err)
+	}
+	defer lk.Close()
+	lo, err := lk.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("no local interface in netns: %w", err)
+	}
+	if err := lk.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("cannot start lo: %w", err)
+	}
+
+	lablk, err := netlink.NewHandleAt(nslab)
+	if err != nil {
+		return fmt.Errorf("obtaining netlink handle: %w", err)
+	}
+	defer lablk.Close()
+	for _, iface := range node.ifcs {
+		br, err := lablk.LinkByName(iface.net.link)
+		if err != nil {
+			return fmt.Errorf("cannot find parent bridge %s: %w", iface.net.name, err)
+		}
+
+		// hosts boot concurrently, so the peer is created under a name unique in the lab namespace,
+		// and only gets the lab name once moved to the host namespace.
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        iface.link,
+				Alias:       node.name + "." + iface.name,
+				TxQLen:      -1,
+				MasterIndex: br.Attrs().Index,
+			},
+			PeerName:         iface.link + "p",
+			PeerHardwareAddr: iface.mac[:],
+		}
+		rename := func(l netlink.Link) error {
+			if err := netlink.LinkSetDown(l); err != nil {
+				return err
+			}
+			if err := netlink.LinkSetName(l, iface.name); err != nil {
+				return fmt.Errorf("cannot rename %s: %w", l.Attrs().Name, err)
+			}
+			return netlink.LinkSetUp(l)
+		}
+		if err := addveth(nslab, nshost, veth, rename, func(l netlink.Link) error { return ifaceAddrs(l, iface) }); err != nil {
+			return fmt.Errorf("cannot create interface %s: %w", iface.name, err)
+		}
+		if err := setVlans(lablk, veth, iface.vlans); err != nil {
+			return fmt.Errorf("configuring interface %s: %w", iface.name, err)
+		}
+		if !iface.impair.IsZero() {
+			if err := iface.impair.apply(lablk, veth); err != nil {
+				return fmt.Errorf("impairing interface %s: %w", iface.name, err)
+			}
+		}
+	}
+
+	script, err := renderInit(node, node.ToTemplate())
+	if err != nil {
+		return err
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+
+	uid, gid, err := UserNumID(lab.Owner)
+	if err != nil {
+		return fmt.Errorf("invalid user id %s: %w", lab.Owner.Uid, err)
+	}
+	revert, err := switchns(nshost)
+	if err != nil {
+		return fmt.Errorf("cannot switch to host namespace: %w", err)
+	}
+	defer revert()
+
+	// the script runs as the lab owner, but can manage the namespace network
+	cmd := exec.Command("/bin/sh", "-c", script.String())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential:  &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		AmbientCaps: []uintptr{unix.CAP_NET_ADMIN, unix.CAP_NET_RAW, unix.CAP_NET_BIND_SERVICE},
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("running init script: %w: %s", err, out)
+	}
+	return nil
+}
+
+// ifaceAddrs configures the static addresses of iface on l, and the default route on NATed networks.
+func ifaceAddrs(l netlink.Link, iface *netiface) error {
+	for _, ad := range []struct {
+		addr Addr
+		net  netip.Prefix
+	}{{iface.addr, iface.net.network}, {iface.addr6, iface.net.network6}} {
+		if !ad.addr.IsValid() {
+			continue
+		}
+		addr, _ := netlink.ParseAddr(netip.PrefixFrom(ad.addr.Addr(), ad.net.Bits()).String())
+		if err := netlink.AddrAdd(l, addr); err != nil {
+			return fmt.Errorf("cannot assign address %s: %w", addr, err)
+		}
+	}
+
+	if iface.net.nat && iface.addr.IsValid() {
+		gw := last(iface.net.network)
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: l.Attrs().Index, Gw: gw.AsSlice()}); err != nil {
+			return fmt.Errorf("cannot set default route: %w", err)
+		}
+	}
+	return nil
+}
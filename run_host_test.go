@@ -0,0 +1,102 @@
+package labomatic
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.starlark.net/starlark"
+)
+
+func TestRunHostConcurrent(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces needs root")
+	}
+	const script = `
+lan = Subnet(link_only=True)
+hosts = [Host() for i in range(8)]
+for h in hosts:
+    h.attach_nic(lan)
+`
+	globals, err := starlark.ExecFileOptions(FileOptions, &starlark.Thread{}, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	var hosts []*netnode
+	for v := range globals["hosts"].(*starlark.List).Elements() {
+		hosts = append(hosts, v.(*netnode))
+	}
+	lab := NewInstance(fmt.Sprintf("t%d", os.Getpid()%10000), t.TempDir(), user.User{})
+
+	// the lab namespace, with the bridge of lan, as Build leaves it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	nsdefault, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netns.Set(nsdefault)
+	nslab, err := netns.NewNamed(lab.netns())
+	if err != nil {
+		t.Skipf("cannot create network namespace: %s", err)
+	}
+	defer netns.DeleteNamed(lab.netns())
+	for _, h := range hosts {
+		defer netns.DeleteNamed(lab.hostns(h.name))
+	}
+	net := hosts[0].ifcs[0].net
+	net.link = "lbr1"
+	if err := addup(nslab, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: net.link, TxQLen: -1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// all hosts create their interface at the same time, as in Build
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, len(hosts))
+	for i, h := range hosts {
+		h.ifcs[0].link = fmt.Sprintf("vh%d_0", i+1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the thread is left in a lab namespace, and never unlocked
+			runtime.LockOSThread()
+			if err := netns.Set(nslab); err != nil {
+				errs[i] = err
+				return
+			}
+			<-start
+			errs[i] = RunHost(lab, h, nslab)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i, h := range hosts {
+		if errs[i] != nil {
+			t.Errorf("cannot start %s: %s", h.name, errs[i])
+			continue
+		}
+		ns, err := netns.GetFromName(lab.hostns(h.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lk, err := netlink.NewHandleAt(ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eth0, err := lk.LinkByName("eth0")
+		if err != nil {
+			t.Errorf("%s: no eth0: %s", h.name, err)
+		} else if eth0.Attrs().HardwareAddr.String() != h.ifcs[0].mac.String() {
+			t.Errorf("%s: eth0 has the MAC address of another host: %s", h.name, eth0.Attrs().HardwareAddr)
+		}
+		lk.Close()
+		ns.Close()
+	}
+}
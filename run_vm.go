@@ -1,25 +1,23 @@
 package labomatic
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
+	"strconv"
 	"syscall"
-	"text/template"
 	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-// RunVM starts the given node as virtual machine.
+// RunVM starts the given node of lab as virtual machine, with its QMP monitor on unix socket monitor.
 // If an error is returned, but a non-nil command is returned, the command must be properly terminated.
-func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd, error) {
+func RunVM(lab *Instance, node *netnode, monitor string, taps map[string]*os.File) (*exec.Cmd, error) {
 	base := node.image
 	if base == "" {
 		switch node.typ {
@@ -30,6 +28,8 @@ func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd,
 			base = MikrotikImage
 		case nodeSwitch:
 			base = CyberOSImage
+		case nodeLinux:
+			panic("Linux nodes always have an image")
 		}
 	}
 	if !filepath.IsAbs(base) {
@@ -46,21 +46,23 @@ func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd,
 			return nil, fmt.Errorf("image %s cannot be found in default location [%s,%s]", base, ImagesDefaultLocation, wd)
 		}
 	}
-	uid, gid, err := UserNumID(runas)
+	uid, gid, err := UserNumID(lab.Owner)
 	if err != nil {
-		return nil, fmt.Errorf("invalid user id %s: %w", runas.Uid, err)
+		return nil, fmt.Errorf("invalid user id %s: %w", lab.Owner.Uid, err)
 	}
 
 	// TODO move to unix socket for guest agent
-	TelnetNum++
+	port := lab.nextTelnet()
 	args := []string{
-		"-machine", "accel=kvm,type=q35",
+		"-machine", "accel=kvm,type=" + node.res.machine,
 		"-cpu", "host",
-		"-m", "512",
+		"-smp", strconv.Itoa(node.res.cpus),
+		"-m", strconv.Itoa(int(node.res.memory)),
 		"-nographic",
 		"-monitor", "none",
+		"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", monitor),
 		"-device", "virtio-rng-pci",
-		"-chardev", fmt.Sprintf("socket,id=ga0,host=127.0.10.1,port=%d,server=on,wait=off", TelnetNum),
+		"-chardev", fmt.Sprintf("socket,id=ga0,host=127.0.10.1,port=%d,server=on,wait=off", port),
 		"-device", "virtio-serial",
 		"-device", fmt.Sprintf("virtserialport,chardev=ga0,name=%s", node.agent().Path()),
 		"-serial", fmt.Sprintf("pty"),
@@ -71,7 +73,7 @@ func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd,
 			"-initrd", "/usr/lib/labomatic/assets.initfs",
 			"-append", "console=ttyS0")
 	} else {
-		vst := filepath.Join(TmpDir, node.name+".qcow2")
+		vst := filepath.Join(lab.TmpDir, node.name+".qcow2")
 		cmd := exec.Command("/usr/bin/qemu-img", "create",
 			"-f", "qcow2", "-F", "qcow2",
 			"-b", base,
@@ -94,6 +96,14 @@ func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd,
 		if node.typ == nodeRouter {
 			args = append(args, "-drive", fmt.Sprintf("format=qcow2,file=%s", vst))
 		}
+		if node.typ == nodeLinux {
+			seed := filepath.Join(lab.TmpDir, node.name+"-seed.img")
+			if err := writeSeed(seed, node); err != nil {
+				return nil, fmt.Errorf("creating cloud-init seed: %w", err)
+			}
+			args = append(args, "-drive", fmt.Sprintf("if=virtio,format=qcow2,file=%s", vst))
+			args = append(args, "-drive", fmt.Sprintf("if=virtio,format=raw,readonly=on,file=%s", seed))
+		}
 	}
 
 	if node.uefi {
@@ -107,9 +117,9 @@ func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd,
 	if len(node.ifcs) == 0 {
 		args = append(args, "-nic", "none")
 	}
-	for i := range node.ifcs {
+	for i, iface := range node.ifcs {
 		args = append(args,
-			"-nic", fmt.Sprintf("tap,fd=%d,model=e1000,mac=52:54:00:%s", fdtap+i, rndmac()),
+			"-nic", fmt.Sprintf("tap,fd=%d,model=e1000,mac=%s", fdtap+i, iface.mac),
 		)
 	}
 	cm := exec.Command("/usr/bin/qemu-system-x86_64", args...)
@@ -128,14 +138,17 @@ func RunVM(node *netnode, taps map[string]*os.File, runas user.User) (*exec.Cmd,
 		return nil, fmt.Errorf("running qemu: %w", err)
 	}
 
-	if err := ExecGuest(TelnetNum, node); err != nil {
+	if err := ExecGuest(lab, port, node); err != nil {
 		return cm, err
 	}
 
 	return cm, nil
 }
 
-func ExecGuest(portnum int, node *netnode) error {
+// agentTimeout bounds each command sent to the guest agent.
+const agentTimeout = 8 * time.Second
+
+func ExecGuest(lab *Instance, portnum int, node *netnode) error {
 	// we need to wait for QEMU to set up the agent socket before asking
 	// to early in the boot, and we never get an answer
 	// later, but still before the agent respond, and we need to spin sending messages, but the agent will replay them
@@ -144,12 +157,21 @@ func ExecGuest(portnum int, node *netnode) error {
 	if node.typ == nodeSwitch {
 		return nil // TODO(rdo) build better
 	}
+	if node.typ == nodeLinux && node.init == "" && node.initfile == "" {
+		return nil // provisioned by cloud-init, and the image might not have a guest agent
+	}
 
-	qemuAgent, err := OpenQMP("lab", "tcp", fmt.Sprintf("127.0.10.1:%d", portnum))
+	qemuAgent, err := OpenQMP(lab.netns(), "tcp", fmt.Sprintf("127.0.10.1:%d", portnum))
 	if err != nil {
 		return fmt.Errorf("cannot contact qmp: %w", err)
 	}
 	defer qemuAgent.Close()
+	// the agent does not answer until the guest is up, commands are retried after the timeout
+	do := func(cmd string, args, repl any) error {
+		ctx, cancel := context.WithTimeout(context.Background(), agentTimeout)
+		defer cancel()
+		return qemuAgent.Do(ctx, cmd, args, repl)
+	}
 
 	dt := node.ToTemplate()
 
@@ -160,15 +182,11 @@ waitUp:
 	slog.Debug("wait for interfaces to be up",
 		"node", node.name,
 		"attempt", 6-tries)
-	wantnames := make(map[string]bool)
-	for _, iface := range dt.Interfaces {
-		wantnames[iface.Name] = true
-	}
 	var GuestNetworkInterface []struct {
 		Name            string `json:"name"`
 		HardwareAddress string `json:"hardware-address"`
 	}
-	if err := qemuAgent.Do("guest-network-get-interfaces", nil, &GuestNetworkInterface); errors.Is(err, os.ErrDeadlineExceeded) {
+	if err := do("guest-network-get-interfaces", nil, &GuestNetworkInterface); errors.Is(err, context.DeadlineExceeded) {
 		if tries--; tries == 0 {
 			return fmt.Errorf("timeout waiting for interfaces")
 		}
@@ -178,36 +196,28 @@ waitUp:
 		return fmt.Errorf("listing interfaces: %w", err)
 	}
 
+	guestnames := make(map[string]string)
 	for _, iface := range GuestNetworkInterface {
-		delete(wantnames, iface.Name)
+		guestnames[iface.HardwareAddress] = iface.Name
 	}
-
-	if len(wantnames) > 0 {
+	if missing := guestIfnames(&dt, node.ifcs, guestnames); missing != nil {
 		if tries--; tries == 0 {
-			return fmt.Errorf("timeout waiting for interfaces")
+			return fmt.Errorf("timeout waiting for interface %s (%s)", missing.name, missing.mac)
 		}
 		time.Sleep(2 * time.Second << (5 - tries))
 		goto waitUp
 	}
 
-	iniscript := node.agent().defaultInit() + node.init
-	exp, err := template.New("init").Funcs(template.FuncMap{
-		"last_address": last,
-	}).Parse(iniscript)
+	buf, err := renderInit(node, dt)
 	if err != nil {
-		return fmt.Errorf("invalid init script: %w", err)
-	}
-
-	buf := new(bytes.Buffer)
-	if err := exp.Execute(buf, dt); err != nil {
-		return fmt.Errorf("invalid init script: %w", err)
+		return err
 	}
 	slog.Debug("execute on guest", "cmd", buf.String())
 
 	var execresult struct {
 		PID int `json:"pid"`
 	}
-	err = qemuAgent.Do("guest-exec", node.agent().Execute(buf.Bytes()), &execresult)
+	err = do("guest-exec", node.agent().Execute(buf.Bytes()), &execresult)
 	if err != nil {
 		return fmt.Errorf("running provisioning script: %w", err)
 	}
@@ -220,7 +230,7 @@ waitUp:
 			OutData  []byte `json:"out-data"`
 			ErrData  []byte `json:"err-data"`
 		}
-		err := qemuAgent.Do("guest-exec-status", struct {
+		err := do("guest-exec-status", struct {
 			PID int `json:"pid"`
 		}{execresult.PID}, &GuestExecStatus)
 		if err != nil {
@@ -248,10 +258,24 @@ waitUp:
 	return fmt.Errorf("could not properly seed machine")
 }
 
-func rndmac() string {
-	mc := make([]byte, 3)
-	rand.Read(mc)
-	return fmt.Sprintf("%x:%x:%x", mc[0], mc[1], mc[2])
+// guestIfnames renames the template interfaces after the guest interfaces (keyed by hardware address) with the same MAC,
+// since the names in the guest depend on the PCI layout QEMU produces.
+// The first interface not found in the guest is returned.
+func guestIfnames(dt *TemplateNode, ifcs []*netiface, guestnames map[string]string) *netiface {
+	bymac := make(map[Mac]string, len(guestnames))
+	for hw, name := range guestnames {
+		if mac, err := ParseMac(hw); err == nil {
+			bymac[mac] = name
+		}
+	}
+	for i, iface := range ifcs {
+		name, ok := bymac[iface.mac]
+		if !ok {
+			return iface
+		}
+		dt.Interfaces[i].Name = name
+	}
+	return nil
 }
 
 // works around different implementations of the agent
@@ -283,6 +307,12 @@ func (chr) defaultInit() string {
 {{ else if not .LinkOnly}}
 /ip/dhcp-client/add interface={{.Name}}
 {{ end }}
+{{ if .Address6.IsValid }}
+/ipv6/address/add interface={{.Name}} address={{.Address6}}/{{.Network6.Bits}} advertise=no
+{{ end }}
+{{ $iface := .Name }}{{ range .Trunk }}
+/interface/vlan/add interface={{$iface}} vlan-id={{.}} name={{$iface}}.{{.}}
+{{ end }}
 {{ end }}
 /system/identity/set name="{{.Name}}"
 `
@@ -305,6 +335,18 @@ func (csw) defaultInit() string {
 {{ if .Address.IsValid }}
 ip addr add dev {{.Name}} {{.Address}}/{{.Network.Bits}}
 {{ end }}
+{{ if .Address6.IsValid }}
+ip -6 addr add dev {{.Name}} {{.Address6}}/{{.Network6.Bits}}
+{{ end }}
+{{ $iface := .Name }}{{ range .Trunk }}
+ip link add link {{$iface}} name {{$iface}}.{{.}} type vlan id {{.}}
+ip link set {{$iface}}.{{.}} up
+{{ end }}
 {{ end }}
 `
 }
+
+// linux nodes are configured by cloud-init, the guest agent only runs the init script.
+type linux struct{ csw }
+
+func (linux) defaultInit() string { return "" }
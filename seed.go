@@ -0,0 +1,263 @@
+package labomatic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf16"
+)
+
+// NoCloud seed for Linux nodes, see https://cloudinit.readthedocs.io/en/latest/reference/datasources/nocloud.html
+// The seed is a FAT disk labelled cidata, holding the meta-data, user-data and network-config files.
+
+var nocloudMetadata = template.Must(template.New("meta-data").Parse(`instance-id: labomatic-{{.Name}}
+local-hostname: {{.Name}}
+public-keys:
+  - {{.Host.PubKey}}
+{{- range .SSHKeys }}
+  - {{.}}
+{{- end }}
+`))
+
+var nocloudNetwork = template.Must(template.New("network-config").Funcs(template.FuncMap{
+	"last_address": last,
+}).Parse(`version: 2
+ethernets:
+{{- range .Interfaces }}
+  {{.Name}}:
+    match:
+      macaddress: "{{.MAC}}"
+    set-name: {{.Name}}
+{{- if or .Address.IsValid .Address6.IsValid }}
+    addresses:
+{{- if .Address.IsValid }}
+      - {{.Address}}/{{.Network.Bits}}
+{{- end }}
+{{- if .Address6.IsValid }}
+      - {{.Address6}}/{{.Network6.Bits}}
+{{- end }}
+{{- if .NATed }}
+    routes:
+      - to: default
+        via: {{ last_address .Network }}
+    nameservers:
+      addresses: [9.9.9.9, 149.112.112.112]
+{{- end }}
+{{- else if not .LinkOnly }}
+    dhcp4: true
+{{- end }}
+{{- end }}
+`))
+
+// writeSeed creates the NoCloud seed disk for node at path.
+func writeSeed(path string, node *netnode) error {
+	dt := struct {
+		TemplateNode
+		SSHKeys []string
+	}{node.ToTemplate(), node.sshkeys}
+
+	var meta, network bytes.Buffer
+	if err := nocloudMetadata.Execute(&meta, dt); err != nil {
+		return fmt.Errorf("cannot generate meta-data: %w", err)
+	}
+	if err := nocloudNetwork.Execute(&network, dt); err != nil {
+		return fmt.Errorf("cannot generate network-config: %w", err)
+	}
+
+	userdata := node.userdata
+	if userdata == "" {
+		userdata = "#cloud-config\n"
+	}
+
+	img, err := fatImage("cidata", []fatFile{
+		{"meta-data", meta.Bytes()},
+		{"user-data", []byte(userdata)},
+		{"network-config", network.Bytes()},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create seed image: %w", err)
+	}
+	return os.WriteFile(path, img, 0644)
+}
+
+type fatFile struct {
+	name string
+	data []byte
+}
+
+// FAT12 geometry: small enough for seeds, big enough for any reasonable user data.
+const (
+	fatSectorSize  = 512
+	fatClusterSize = 4 * fatSectorSize
+	fatRootEntries = 64
+	fatMaxClusters = 4084 // over that, this becomes FAT16
+)
+
+// fatImage returns a FAT12 disk image with the given volume label, holding files in the root directory.
+// Long file names (VFAT) are used, since cloud-init files do not fit in 8.3 names.
+func fatImage(label string, files []fatFile) ([]byte, error) {
+	var root []byte
+	root = append(root, fatEntry(fatShortName(label), 0x08, 0, 0)...)
+
+	clusters := 2 // first data cluster
+	var chains [][2]int
+	for i, f := range files {
+		n := (len(f.data) + fatClusterSize - 1) / fatClusterSize
+		start := 0
+		if n > 0 {
+			start = clusters
+		}
+		chains = append(chains, [2]int{start, n})
+
+		short := fatShortName(fmt.Sprintf("%.6s~%d", strings.ToUpper(f.name), i+1))
+		root = append(root, fatLongName(f.name, short)...)
+		root = append(root, fatEntry(short, 0x20, start, len(f.data))...)
+		clusters += n
+	}
+	clusters -= 2
+	if clusters > fatMaxClusters {
+		return nil, fmt.Errorf("files too large for seed (%d clusters)", clusters)
+	}
+	if len(root) > fatRootEntries*32 {
+		return nil, fmt.Errorf("too many files in seed")
+	}
+
+	const (
+		reserved    = 1
+		rootSectors = fatRootEntries * 32 / fatSectorSize
+	)
+	fatSectors := ((clusters+2)*3/2 + fatSectorSize) / fatSectorSize
+	dataStart := (reserved + 2*fatSectors + rootSectors) * fatSectorSize
+	total := dataStart/fatSectorSize + clusters*fatClusterSize/fatSectorSize
+
+	img := make([]byte, total*fatSectorSize)
+
+	// boot sector and BIOS parameter block
+	le := binary.LittleEndian
+	copy(img[0:], []byte{0xEB, 0x3C, 0x90})
+	copy(img[3:], "MSWIN4.1")
+	le.PutUint16(img[11:], fatSectorSize)
+	img[13] = fatClusterSize / fatSectorSize
+	le.PutUint16(img[14:], reserved)
+	img[16] = 2
+	le.PutUint16(img[17:], fatRootEntries)
+	le.PutUint16(img[19:], uint16(total))
+	img[21] = 0xF8
+	le.PutUint16(img[22:], uint16(fatSectors))
+	le.PutUint16(img[24:], 32)
+	le.PutUint16(img[26:], 64)
+	img[36] = 0x80
+	img[38] = 0x29
+	le.PutUint32(img[39:], 0x1abc0de)
+	copy(img[43:54], fatShortName(label))
+	copy(img[54:62], "FAT12   ")
+	img[510], img[511] = 0x55, 0xAA
+
+	fat := make([]byte, fatSectors*fatSectorSize)
+	fat12Set(fat, 0, 0xFF8)
+	fat12Set(fat, 1, 0xFFF)
+	for _, ch := range chains {
+		for c := ch[0]; c < ch[0]+ch[1]; c++ {
+			next := c + 1
+			if next == ch[0]+ch[1] {
+				next = 0xFFF
+			}
+			fat12Set(fat, c, next)
+		}
+	}
+	copy(img[reserved*fatSectorSize:], fat)
+	copy(img[(reserved+fatSectors)*fatSectorSize:], fat)
+	copy(img[(reserved+2*fatSectors)*fatSectorSize:], root)
+
+	for i, f := range files {
+		if chains[i][1] == 0 {
+			continue
+		}
+		copy(img[dataStart+(chains[i][0]-2)*fatClusterSize:], f.data)
+	}
+
+	return img, nil
+}
+
+func fat12Set(fat []byte, cluster, v int) {
+	off := cluster + cluster/2
+	if cluster%2 == 0 {
+		fat[off] = byte(v)
+		fat[off+1] = fat[off+1]&0xF0 | byte(v>>8)&0x0F
+	} else {
+		fat[off] = fat[off]&0x0F | byte(v<<4)
+		fat[off+1] = byte(v >> 4)
+	}
+}
+
+// fatShortName returns name as a padded, upper-case 11 bytes 8.3 name.
+func fatShortName(name string) []byte {
+	sn := []byte(strings.ToUpper(name))
+	if len(sn) > 11 {
+		sn = sn[:11]
+	}
+	return append(sn, bytes.Repeat([]byte{' '}, 11-len(sn))...)
+}
+
+// fixed timestamp, so that images are reproducible
+const fatDate = (2024-1980)<<9 | 1<<5 | 1
+
+func fatEntry(short []byte, attr byte, cluster, size int) []byte {
+	ent := make([]byte, 32)
+	copy(ent, short)
+	ent[11] = attr
+	le := binary.LittleEndian
+	le.PutUint16(ent[16:], fatDate)
+	le.PutUint16(ent[18:], fatDate)
+	le.PutUint16(ent[24:], fatDate)
+	le.PutUint16(ent[26:], uint16(cluster))
+	le.PutUint32(ent[28:], uint32(size))
+	return ent
+}
+
+// fatLongName returns the VFAT entries for name, to be placed before the short entry.
+func fatLongName(name string, short []byte) []byte {
+	var sum byte
+	for _, b := range short {
+		sum = (sum&1)<<7 + sum>>1 + b
+	}
+
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xFFFF)
+	}
+
+	n := len(chars) / 13
+	ents := make([]byte, 0, 32*n)
+	for seq := n; seq > 0; seq-- {
+		ent := make([]byte, 32)
+		ent[0] = byte(seq)
+		if seq == n {
+			ent[0] |= 0x40
+		}
+		ent[11] = 0x0F
+		ent[13] = sum
+
+		part := chars[(seq-1)*13 : seq*13]
+		for i, c := range part {
+			var off int
+			switch {
+			case i < 5:
+				off = 1 + 2*i
+			case i < 11:
+				off = 14 + 2*(i-5)
+			default:
+				off = 28 + 2*(i-11)
+			}
+			binary.LittleEndian.PutUint16(ent[off:], c)
+		}
+		ents = append(ents, ent...)
+	}
+	return ents
+}
@@ -0,0 +1,92 @@
+package labomatic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestFATImage(t *testing.T) {
+	files := []fatFile{
+		{"meta-data", []byte("instance-id: labomatic-l1\n")},
+		{"user-data", bytes.Repeat([]byte("#cloud-config\n"), 500)}, // several clusters
+		{"network-config", []byte("version: 2\n")},
+		{"empty", nil},
+	}
+
+	img, err := fatImage("cidata", files)
+	if err != nil {
+		t.Fatalf("cannot create image: %s", err)
+	}
+
+	got := readFAT(t, img)
+	if got["\x00label"] != "CIDATA" {
+		t.Errorf("invalid label: %q", got["\x00label"])
+	}
+	for _, f := range files {
+		if got[f.name] != string(f.data) {
+			t.Errorf("%s: want %d bytes, got %d", f.name, len(f.data), len(got[f.name]))
+		}
+	}
+}
+
+// readFAT is a minimal FAT12 reader, returning the files in the root directory.
+// The volume label is returned under a name that cannot be a file.
+func readFAT(t *testing.T, img []byte) map[string]string {
+	le := binary.LittleEndian
+	var (
+		sector      = int(le.Uint16(img[11:]))
+		cluster     = int(img[13]) * sector
+		reserved    = int(le.Uint16(img[14:]))
+		nfats       = int(img[16])
+		rootEntries = int(le.Uint16(img[17:]))
+		fatSectors  = int(le.Uint16(img[22:]))
+	)
+	if img[510] != 0x55 || img[511] != 0xAA {
+		t.Fatal("missing boot signature")
+	}
+
+	fat := img[reserved*sector:]
+	root := img[(reserved+nfats*fatSectors)*sector:][:rootEntries*32]
+	data := img[(reserved+nfats*fatSectors)*sector+rootEntries*32:]
+
+	next := func(c int) int {
+		v := int(le.Uint16(fat[c+c/2:]))
+		if c%2 == 0 {
+			return v & 0xFFF
+		}
+		return v >> 4
+	}
+
+	files := make(map[string]string)
+	var long []uint16
+	for ent := root; len(ent) > 0 && ent[0] != 0; ent = ent[32:] {
+		switch ent[11] {
+		case 0x08:
+			files["\x00label"] = strings.TrimSpace(string(ent[:11]))
+		case 0x0F:
+			var part []uint16
+			for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				part = append(part, le.Uint16(ent[off:]))
+			}
+			long = append(part, long...)
+		default:
+			if i := slices.Index(long, 0); i >= 0 {
+				long = long[:i]
+			}
+			name := string(utf16.Decode(long))
+			long = nil
+
+			size := int(le.Uint32(ent[28:]))
+			var content []byte
+			for c := int(le.Uint16(ent[26:])); c >= 2 && c < 0xFF8; c = next(c) {
+				content = append(content, data[(c-2)*cluster:][:cluster]...)
+			}
+			files[name] = string(content[:size])
+		}
+	}
+	return files
+}
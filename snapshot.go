@@ -0,0 +1,266 @@
+package labomatic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SaveSnapshot saves the state of all VMs in the lab as snapshot name, replacing a previous one.
+// Snapshots are internal qcow2 snapshots of the VM overlays in the lab temporary directory, taken through the QMP monitor;
+// all VMs are paused meanwhile, so that the lab is consistent.
+// Host nodes, and VMs without writable qcow2 disks (assets), are not part of snapshots.
+// The result is sent to done.
+func SaveSnapshot(name string, done chan<- error) Controller {
+	return func(s iter.Seq[RunningNode]) {
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		defer cancel()
+		done <- snapshot(ctx, s, "snapshot-save", name)
+	}
+}
+
+// LoadSnapshot rolls back all VMs in the lab to snapshot name.
+// The result is sent to done.
+func LoadSnapshot(name string, done chan<- error) Controller {
+	return func(s iter.Seq[RunningNode]) {
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		defer cancel()
+		done <- snapshot(ctx, s, "snapshot-load", name)
+	}
+}
+
+// snapshotTimeout bounds snapshot operations on the whole lab, and commandTimeout the clean up commands.
+const (
+	snapshotTimeout = 5 * time.Minute
+	commandTimeout  = 8 * time.Second
+)
+
+// snapshotDisks are the block nodes of a VM holding a snapshot.
+type snapshotDisks struct {
+	vm      VMNode
+	mon     *QMP
+	devices []string
+	tags    map[string]snapshotInfo
+}
+
+type snapshotInfo struct {
+	Name     string `json:"name"`
+	VMSize   int64  `json:"vm-state-size"`
+	DateSec  int64  `json:"date-sec"`
+	DateNsec int64  `json:"date-nsec"`
+}
+
+// openSnapshots connects to the monitor of every VM in the lab that can be snapshot.
+// Monitors must be closed by the caller, including on error.
+func openSnapshots(ctx context.Context, s iter.Seq[RunningNode]) ([]*snapshotDisks, error) {
+	var vms []*snapshotDisks
+	for n := range s {
+		vm, ok := n.(VMNode)
+		if !ok || vm.qmp == "" {
+			continue
+		}
+		mon, err := OpenMonitor(ctx, vm.qmp)
+		if err != nil {
+			return vms, fmt.Errorf("%s: %w", vm.node.name, err)
+		}
+		sd := &snapshotDisks{vm: vm, mon: mon, tags: make(map[string]snapshotInfo)}
+		vms = append(vms, sd)
+
+		var blocks []struct {
+			Inserted *struct {
+				NodeName string `json:"node-name"`
+				Driver   string `json:"drv"`
+				ReadOnly bool   `json:"ro"`
+				Image    struct {
+					Snapshots []snapshotInfo `json:"snapshots"`
+				} `json:"image"`
+			} `json:"inserted"`
+		}
+		if err := mon.Do(ctx, "query-block", nil, &blocks); err != nil {
+			return vms, fmt.Errorf("%s: cannot list disks: %w", vm.node.name, err)
+		}
+		for _, b := range blocks {
+			if b.Inserted == nil || b.Inserted.ReadOnly || b.Inserted.Driver != "qcow2" {
+				continue
+			}
+			sd.devices = append(sd.devices, b.Inserted.NodeName)
+			for _, snap := range b.Inserted.Image.Snapshots {
+				sd.tags[snap.Name] = snap
+			}
+		}
+		if len(sd.devices) == 0 {
+			mon.Close()
+			vms = vms[:len(vms)-1]
+		}
+	}
+	return vms, nil
+}
+
+func closeSnapshots(vms []*snapshotDisks) {
+	for _, sd := range vms {
+		sd.mon.Close()
+	}
+}
+
+// snapshot runs the snapshot job cmd (snapshot-save or snapshot-load) on all VMs, while the lab is paused.
+func snapshot(ctx context.Context, s iter.Seq[RunningNode], cmd, name string) error {
+	vms, err := openSnapshots(ctx, s)
+	defer closeSnapshots(vms)
+	if err != nil {
+		return err
+	}
+	if len(vms) == 0 {
+		return fmt.Errorf("no VM in the lab can be snapshot")
+	}
+	if cmd == "snapshot-load" {
+		for _, sd := range vms {
+			if _, ok := sd.tags[name]; !ok {
+				return fmt.Errorf("no snapshot %s on %s", name, sd.vm.node.name)
+			}
+		}
+	}
+
+	// VMs are resumed even if the snapshot failed
+	for _, sd := range vms {
+		if err := sd.mon.Do(ctx, "stop", nil, nil); err != nil {
+			err = fmt.Errorf("%s: cannot pause: %w", sd.vm.node.name, err)
+			return errors.Join(err, resume(vms))
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mx   sync.Mutex
+		errs []error
+	)
+	for _, sd := range vms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sd.snapshot(ctx, cmd, name)
+			if err != nil {
+				mx.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", sd.vm.node.name, err))
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(append(errs, resume(vms))...)
+}
+
+// resume continues all VMs, even if the snapshot timed out.
+func resume(vms []*snapshotDisks) error {
+	var errs []error
+	for _, sd := range vms {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		err := sd.mon.Do(ctx, "cont", nil, nil)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: cannot resume: %w", sd.vm.node.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// snapshot runs the snapshot job cmd on the VM, and waits for its completion.
+// The VM state is stored on the first disk.
+func (sd *snapshotDisks) snapshot(ctx context.Context, cmd, name string) error {
+	if _, ok := sd.tags[name]; ok && cmd == "snapshot-save" {
+		if err := sd.job(ctx, "snapshot-delete", map[string]any{"tag": name, "devices": sd.devices}); err != nil {
+			return fmt.Errorf("cannot replace snapshot %s: %w", name, err)
+		}
+	}
+	return sd.job(ctx, cmd, map[string]any{"tag": name, "vmstate": sd.devices[0], "devices": sd.devices})
+}
+
+// job starts job cmd with args, and polls until it concludes.
+func (sd *snapshotDisks) job(ctx context.Context, cmd string, args map[string]any) error {
+	id := cmd + "-" + sd.vm.node.name
+	args["job-id"] = id
+	if err := sd.mon.Do(ctx, cmd, args, nil); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		sd.mon.Do(ctx, "job-dismiss", map[string]string{"id": id}, nil)
+	}()
+
+	type jobInfo struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	for {
+		var jobs []jobInfo
+		if err := sd.mon.Do(ctx, "query-jobs", nil, &jobs); err != nil {
+			return fmt.Errorf("cannot query job %s: %w", id, err)
+		}
+		i := slices.IndexFunc(jobs, func(j jobInfo) bool { return j.ID == id })
+		switch {
+		case i == -1:
+			return fmt.Errorf("job %s disappeared", id)
+		case jobs[i].Status == "concluded" && jobs[i].Error != "":
+			return fmt.Errorf("%s", jobs[i].Error)
+		case jobs[i].Status == "concluded":
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("job %s did not conclude: %w", id, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// ListSnapshots writes the snapshots of the lab, as a table.
+// Only snapshots present on all VMs are listed, since others cannot be loaded.
+// The result is sent to done.
+func ListSnapshots(into io.Writer, done chan<- error) Controller {
+	return func(s iter.Seq[RunningNode]) {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		vms, err := openSnapshots(ctx, s)
+		defer closeSnapshots(vms)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		fmt.Fprintln(into, "\033[1mname                 date                 vm state\033[0m")
+		if len(vms) == 0 {
+			done <- nil
+			return
+		}
+		for _, name := range slices.Sorted(maps.Keys(vms[0].tags)) {
+			var (
+				size int64
+				date time.Time
+				all  = true
+			)
+			for _, sd := range vms {
+				snap, ok := sd.tags[name]
+				if !ok {
+					all = false
+					break
+				}
+				size += snap.VMSize
+				if t := time.Unix(snap.DateSec, snap.DateNsec); t.After(date) {
+					date = t
+				}
+			}
+			if all {
+				fmt.Fprintf(into, "%-20s %-20s %dMiB\n", name, date.Format(time.DateTime), size>>20)
+			}
+		}
+		done <- nil
+	}
+}
@@ -0,0 +1,153 @@
+package labomatic
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMonitor serves a QMP monitor on a unix socket in dir, recording the commands received.
+// The VM has a single disk, with snapshots tags.
+type fakeMonitor struct {
+	path string
+	tags []string
+
+	mx   sync.Mutex
+	cmds []string
+}
+
+func newFakeMonitor(t *testing.T, name string, tags ...string) *fakeMonitor {
+	fm := &fakeMonitor{path: filepath.Join(t.TempDir(), name+".qmp"), tags: tags}
+	ln, err := net.Listen("unix", fm.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fm.serve(conn)
+		}
+	}()
+	return fm
+}
+
+func (fm *fakeMonitor) serve(conn net.Conn) {
+	defer conn.Close()
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{"oob"}}})
+	for {
+		var req struct {
+			Execute   string          `json:"execute"`
+			Arguments map[string]any  `json:"arguments"`
+			ID        json.RawMessage `json:"id"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		fm.mx.Lock()
+		if req.Execute != "qmp_capabilities" && req.Execute != "query-jobs" {
+			fm.cmds = append(fm.cmds, strings.TrimSpace(req.Execute+" "+toString(req.Arguments["tag"])))
+		}
+		fm.mx.Unlock()
+
+		var ret any = map[string]any{}
+		switch req.Execute {
+		case "query-block":
+			var snaps []map[string]any
+			for _, tag := range fm.tags {
+				snaps = append(snaps, map[string]any{"name": tag, "vm-state-size": 64 << 20, "date-sec": 1700000000})
+			}
+			ret = []map[string]any{
+				{"device": "", "inserted": map[string]any{"node-name": "#block123", "drv": "qcow2", "ro": false,
+					"image": map[string]any{"snapshots": snaps}}},
+				{"device": "pflash0", "inserted": map[string]any{"node-name": "#block321", "drv": "raw", "ro": true}},
+			}
+		case "snapshot-save", "snapshot-load", "snapshot-delete":
+			// events are interleaved with responses
+			enc.Encode(map[string]any{"event": "JOB_STATUS_CHANGE", "data": map[string]any{"status": "created"}})
+		case "query-jobs":
+			ret = []map[string]any{{"id": "other", "status": "running"}, {"id": "snapshot-save-r1", "status": "concluded"},
+				{"id": "snapshot-load-r1", "status": "concluded"}, {"id": "snapshot-delete-r1", "status": "concluded"},
+				{"id": "snapshot-save-r2", "status": "concluded"}, {"id": "snapshot-load-r2", "status": "concluded"},
+				{"id": "snapshot-delete-r2", "status": "concluded", "error": "disk is busy"}}
+		}
+		enc.Encode(map[string]any{"return": ret, "id": req.ID})
+	}
+}
+
+func toString(v any) string { s, _ := v.(string); return s }
+
+func (fm *fakeMonitor) commands() string {
+	fm.mx.Lock()
+	defer fm.mx.Unlock()
+	return strings.Join(fm.cmds, ", ")
+}
+
+func TestSnapshot(t *testing.T) {
+	r1 := newFakeMonitor(t, "r1", "base")
+	lab := slices.Values([]RunningNode{
+		VMNode{node: &netnode{name: "r1"}, qmp: r1.path},
+		AssetNode{node: &netnode{name: "pc1"}},
+	})
+
+	done := make(chan error, 1)
+	SaveSnapshot("clean", done)(lab)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := r1.commands(); got != "query-block, stop, snapshot-save clean, job-dismiss, cont" {
+		t.Errorf("save: unexpected commands %s", got)
+	}
+
+	r1.cmds = nil
+	LoadSnapshot("base", done)(lab)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := r1.commands(); got != "query-block, stop, snapshot-load base, job-dismiss, cont" {
+		t.Errorf("load: unexpected commands %s", got)
+	}
+
+	LoadSnapshot("missing", done)(lab)
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "no snapshot missing on r1") {
+		t.Errorf("load: want missing snapshot error, got %v", err)
+	}
+
+	var out strings.Builder
+	ListSnapshots(&out, done)(lab)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "base") || !strings.Contains(out.String(), "64MiB") {
+		t.Errorf("list: want snapshot base, got\n%s", out.String())
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	r1, r2 := newFakeMonitor(t, "r1", "base"), newFakeMonitor(t, "r2", "base")
+	lab := slices.Values([]RunningNode{
+		VMNode{node: &netnode{name: "r1"}, qmp: r1.path},
+		VMNode{node: &netnode{name: "r2"}, qmp: r2.path},
+	})
+
+	// replacing base fails on r2, but all VMs are resumed
+	done := make(chan error, 1)
+	SaveSnapshot("base", done)(lab)
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "r2: cannot replace snapshot base: disk is busy") {
+		t.Errorf("want error replacing snapshot on r2, got %v", err)
+	}
+	if got := r1.commands(); got != "query-block, stop, snapshot-delete base, job-dismiss, snapshot-save base, job-dismiss, cont" {
+		t.Errorf("r1: unexpected commands %s", got)
+	}
+	if got := r2.commands(); !strings.HasSuffix(got, "cont") {
+		t.Errorf("r2: want VM resumed, got commands %s", got)
+	}
+}
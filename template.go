@@ -0,0 +1,202 @@
+package labomatic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"text/template"
+	"text/template/parse"
+
+	"go.starlark.net/starlark"
+)
+
+var initFuncs = template.FuncMap{
+	"last_address": last,
+}
+
+// initTemplate parses the init script of node (inline, or from the init file),
+// prefixed by the agent default for VMs and the commands built with the routeros module.
+// Templates used by the script, but not defined in it, are loaded from files of the same name in the lab directory.
+// Templates are named after their file, so errors report the file and line.
+func (n *netnode) initTemplate() (*template.Template, error) {
+	if n.init != "" && n.initfile != "" {
+		return nil, errors.New("init_script and init_file are both set")
+	}
+
+	var root string
+	if n.typ != nodeHost {
+		root = n.agent().defaultInit()
+	}
+	if len(n.ros) > 0 {
+		root += "{{ routeros_config . }}"
+	}
+	name, script := "init_script", n.init
+	if n.initfile != "" {
+		buf, err := readLabFile(n.labdir, n.initfile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read init file: %w", err)
+		}
+		name, script = n.initfile, string(buf)
+	}
+	if script != "" {
+		root += fmt.Sprintf("{{ template %q . }}", name)
+	}
+
+	exp, err := template.New("init").Funcs(initFuncs).Funcs(template.FuncMap{
+		"routeros_config": n.renderROS,
+	}).Parse(root)
+	if err != nil {
+		return nil, err
+	}
+	if script == "" {
+		return exp, nil
+	}
+	if _, err := exp.New(name).Parse(script); err != nil {
+		return nil, err
+	}
+
+	for {
+		var refs []string
+		for _, t := range exp.Templates() {
+			templateRefs(t.Root, &refs)
+		}
+		loaded := false
+		for _, ref := range refs {
+			if exp.Lookup(ref) != nil {
+				continue
+			}
+			if !filepath.IsLocal(ref) {
+				return nil, fmt.Errorf("template %s is not a file in the lab directory", ref)
+			}
+			buf, err := readLabFile(n.labdir, ref)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read template: %w", err)
+			}
+			if _, err := exp.New(ref).Parse(string(buf)); err != nil {
+				return nil, err
+			}
+			loaded = true
+		}
+		if !loaded {
+			return exp, nil
+		}
+	}
+}
+
+// readLabFile reads file name in labdir.
+// Symbolic links are followed only if they stay within labdir.
+func readLabFile(labdir, name string) ([]byte, error) {
+	fh, err := os.OpenInRoot(labdir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return io.ReadAll(fh)
+}
+
+// RenderInit writes the init script of the node called name in the lab defined by globals, as it would be run.
+// Interfaces are named as in the lab definition, guest names are only known once the node runs.
+func RenderInit(into io.Writer, globals starlark.StringDict, name string) error {
+	for node := range nodesof(globals, OfType(nodeAsset), OfType(nodeSwitch), OfType(nodeRouter), OfType(nodeLinux), OfType(nodeHost)) {
+		if node.name != name {
+			continue
+		}
+		buf, err := renderInit(node, node.ToTemplate())
+		if err != nil {
+			return err
+		}
+		_, err = buf.WriteTo(into)
+		return err
+	}
+	return fmt.Errorf("no node %s in the lab", name)
+}
+
+// templateRefs appends the names of templates invoked under node to refs.
+func templateRefs(node parse.Node, refs *[]string) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			templateRefs(n, refs)
+		}
+	case *parse.TemplateNode:
+		*refs = append(*refs, node.Name)
+	case *parse.IfNode:
+		templateRefs(node.List, refs)
+		templateRefs(node.ElseList, refs)
+	case *parse.RangeNode:
+		templateRefs(node.List, refs)
+		templateRefs(node.ElseList, refs)
+	case *parse.WithNode:
+		templateRefs(node.List, refs)
+		templateRefs(node.ElseList, refs)
+	}
+}
+
+// renderInit expands the init script of node as a template over dt.
+func renderInit(node *netnode, dt TemplateNode) (*bytes.Buffer, error) {
+	exp, err := node.initTemplate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid init script: %w", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := exp.Execute(buf, dt); err != nil {
+		return nil, fmt.Errorf("invalid init script: %w", err)
+	}
+	return buf, nil
+}
+
+// templateValue converts Starlark data to the Go values used in templates.
+// Dictionaries must have string keys, so they can be accessed as fields.
+func templateValue(v starlark.Value) (any, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer %s out of range", v)
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return v.GoString(), nil
+	case Addr:
+		return netip.Addr(v), nil
+	case *starlark.Dict:
+		m := make(map[string]any, v.Len())
+		for _, it := range v.Items() {
+			k, ok := it[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("invalid key %s (want string)", it[0])
+			}
+			e, err := templateValue(it[1])
+			if err != nil {
+				return nil, err
+			}
+			m[k.GoString()] = e
+		}
+		return m, nil
+	case starlark.Indexable: // lists and tuples
+		l := make([]any, v.Len())
+		for i := range l {
+			e, err := templateValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			l[i] = e
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("cannot use %s in template data", v.Type())
+}
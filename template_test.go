@@ -0,0 +1,93 @@
+package labomatic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestInitFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"r1.rsc": `/system/identity/set name={{.Name}}
+{{ template "common.rsc" . }}
+/routing/bgp/connection/add as={{.Vars.asn}}{{ range .Vars.peers }} remote.address={{.}}{{ end }}
+`,
+		"common.rsc": `/ip/dns/set servers={{.Vars.dns}}`,
+		"broken.rsc": `/ip/address/add
+address={{ .Vars.addr }
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const script = `
+r1 = Host()
+r1.init_file = "r1.rsc"
+r1.vars = {"asn": 65001, "peers": ["10.0.0.1", Addr("10.0.0.2")], "dns": "192.0.2.53"}
+`
+	th := &starlark.Thread{}
+	th.SetLocal("labdir", dir)
+	globals, err := starlark.ExecFile(th, "conf.star", script, NetBlocks)
+	if err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	r1 := globals["r1"].(*netnode)
+
+	buf, err := renderInit(r1, TemplateNode{Name: r1.name, Vars: r1.vars})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `/system/identity/set name=h1
+/ip/dns/set servers=192.0.2.53
+/routing/bgp/connection/add as=65001 remote.address=10.0.0.1 remote.address=10.0.0.2
+`
+	if buf.String() != want {
+		t.Errorf("want init script\n%s\ngot\n%s", want, buf.String())
+	}
+
+	r1.initfile = "broken.rsc"
+	if _, err := renderInit(r1, TemplateNode{}); err == nil || !strings.Contains(err.Error(), "broken.rsc:2:") {
+		t.Errorf("want error in broken.rsc:2, got %v", err)
+	}
+	r1.initfile = "missing.rsc"
+	if _, err := renderInit(r1, TemplateNode{}); err == nil {
+		t.Error("want error on missing init file")
+	}
+	r1.initfile, r1.init = "", `{{ template "../etc/passwd" }}`
+	if _, err := renderInit(r1, TemplateNode{}); err == nil {
+		t.Error("want error on template outside of the lab directory")
+	}
+
+	outside := filepath.Join(t.TempDir(), "secret.rsc")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link.rsc")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ file, init string }{{"link.rsc", ""}, {"", `{{ template "link.rsc" }}`}} {
+		r1.initfile, r1.init = c.file, c.init
+		if _, err := renderInit(r1, TemplateNode{}); err == nil {
+			t.Errorf("want error on symbolic link outside of the lab directory (init file %q, script %q)", c.file, c.init)
+		}
+	}
+}
+
+func TestTemplateValue(t *testing.T) {
+	for _, script := range []string{
+		`r1 = Router(); r1.vars = {1: "one"}`,
+		`r1 = Router(); r1.vars = {"node": r1}`,
+		`r1 = Router(); r1.init_file = "../r1.rsc"`,
+	} {
+		if _, err := starlark.ExecFile(&starlark.Thread{}, "conf.star", script, NetBlocks); err == nil {
+			t.Errorf("%s: want error", script)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package labomatic
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"go.starlark.net/starlark"
+)
+
+// vlanport is the VLAN configuration of an interface on a VLAN-filtering subnet.
+// Access ports carry a single untagged VLAN;
+// trunk ports carry tagged VLANs, and optionally a native (untagged) one.
+type vlanport struct {
+	access int
+	trunk  []int
+	native int
+}
+
+func (v vlanport) configured() bool { return v.access != 0 || len(v.trunk) > 0 || v.native != 0 }
+
+// newVlanport validates the VLAN arguments of attach_nic
+func newVlanport(net *subnet, access int, trunk *starlark.List, native int) (vlanport, error) {
+	v := vlanport{access: access, native: native}
+	if trunk != nil {
+		for t := range trunk.Elements() {
+			var vid int
+			if err := starlark.AsInt(t, &vid); err != nil {
+				return v, fmt.Errorf("invalid trunk VLAN %s: %w", t, err)
+			}
+			v.trunk = append(v.trunk, vid)
+		}
+	}
+
+	switch {
+	case !v.configured():
+		return v, nil
+	case !net.vlanfiltering:
+		return v, fmt.Errorf("VLANs require a subnet with vlan_filtering=True")
+	case v.access != 0 && (len(v.trunk) > 0 || v.native != 0):
+		return v, fmt.Errorf("an interface is either an access port (vlan) or a trunk (trunk, native)")
+	case v.native != 0 && len(v.trunk) == 0:
+		return v, fmt.Errorf("native VLAN only makes sense for trunks")
+	}
+
+	for _, vid := range []int{v.access, v.native} {
+		if vid < 0 || vid > 4094 {
+			return v, fmt.Errorf("invalid VLAN id %d", vid)
+		}
+	}
+	for _, vid := range v.trunk {
+		if vid < 1 || vid > 4094 {
+			return v, fmt.Errorf("invalid VLAN id %d", vid)
+		}
+	}
+	return v, nil
+}
+
+func (v vlanport) trunkList() *starlark.List {
+	vids := make([]starlark.Value, len(v.trunk))
+	for i, vid := range v.trunk {
+		vids[i] = starlark.MakeInt(vid)
+	}
+	return starlark.NewList(vids)
+}
+
+// setVlans programs the bridge VLAN entries of the port link, replacing the default PVID 1.
+func setVlans(lk *netlink.Handle, link netlink.Link, v vlanport) error {
+	if !v.configured() {
+		return nil
+	}
+
+	const defaultPVID = 1
+	if err := lk.BridgeVlanDel(link, defaultPVID, true, true, false, true); err != nil {
+		return fmt.Errorf("cannot remove default VLAN: %w", err)
+	}
+
+	if v.access != 0 {
+		if err := lk.BridgeVlanAdd(link, uint16(v.access), true, true, false, true); err != nil {
+			return fmt.Errorf("cannot set access VLAN %d: %w", v.access, err)
+		}
+		return nil
+	}
+
+	for _, vid := range v.trunk {
+		if err := lk.BridgeVlanAdd(link, uint16(vid), false, false, false, true); err != nil {
+			return fmt.Errorf("cannot add trunk VLAN %d: %w", vid, err)
+		}
+	}
+	if v.native != 0 {
+		if err := lk.BridgeVlanAdd(link, uint16(v.native), true, true, false, true); err != nil {
+			return fmt.Errorf("cannot set native VLAN %d: %w", v.native, err)
+		}
+	}
+	return nil
+}